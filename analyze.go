@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/macdylan/SMFix/fix"
+)
+
+// filament of the weight estimate if the slicer header has none, PLA
+const (
+	defaultFilamentDiameter = 1.75 // mm
+	defaultFilamentDensity  = 1.24 // g/cm³
+)
+
+// gcodeStats is what the analyzer found in a file.
+type gcodeStats struct {
+	Min         [3]float64      `json:"min"` // X, Y, Z of the work moves
+	Max         [3]float64      `json:"max"`
+	Nozzle      map[int]float64 `json:"nozzle,omitempty"` // max temperature by tool
+	Bed         float64         `json:"bed,omitempty"`
+	Tools       []int           `json:"tools,omitempty"`     // tools that extrude
+	Extrusion   map[int]float64 `json:"extrusion,omitempty"` // filament (mm) by tool
+	Module      string          `json:"module"`
+	Model       string          `json:"model,omitempty"` // from the slicer header
+	Time        float64         `json:"time"`            // estimated print time (s)
+	Kinematics  string          `json:"kinematics"`      // model of the motion limits
+	Layers      int             `json:"layers,omitempty"`
+	ToolChanges int             `json:"tool_changes,omitempty"`
+
+	// estimates of the slicer, from the header
+	SlicerTime     float64   `json:"slicer_time,omitempty"`     // s
+	SlicerFilament []float64 `json:"slicer_filament,omitempty"` // mm by tool
+
+	known      [3]bool   // the axis has work moves
+	dual       bool      // the header asks for the dual extrusion module
+	diameter   []float64 // filament by tool, from the header
+	density    []float64
+	layerMarks [2]int // ;LAYER_CHANGE and ;LAYER: comments
+}
+
+// filament returns the volume (cm³) and weight (g) of the filament of tool.
+func (s *gcodeStats) filament(tool int) (volume, weight float64) {
+	d, rho := defaultFilamentDiameter, defaultFilamentDensity
+	if v := byTool(s.diameter, tool); v > 0 {
+		d = v
+	}
+	if v := byTool(s.density, tool); v > 0 {
+		rho = v
+	}
+	volume = s.Extrusion[tool] * math.Pi * d * d / 4 / 1000
+	return math.Round(volume*1000) / 1000, math.Round(volume*rho*1000) / 1000
+}
+
+// byTool returns the value of tool in a list of the slicer, which may only
+// have the value of the first tool.
+func byTool(values []float64, tool int) float64 {
+	switch {
+	case tool < len(values):
+		return values[tool]
+	case len(values) > 0:
+		return values[0]
+	}
+	return 0
+}
+
+// isGcodeFile tells if the analyzer reads the file name.
+func isGcodeFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gcode", ".nc", ".cnc":
+		return true
+	}
+	return false
+}
+
+// gcodeFloat returns a parameter as float64 without the noise of float32.
+func gcodeFloat(v float32) float64 {
+	return math.Round(float64(v)*1e4) / 1e4
+}
+
+func (s *gcodeStats) add(pos [3]float64, known [3]bool) {
+	for i := range pos {
+		if !known[i] {
+			continue
+		}
+		if !s.known[i] || pos[i] < s.Min[i] {
+			s.Min[i] = pos[i]
+		}
+		if !s.known[i] || pos[i] > s.Max[i] {
+			s.Max[i] = pos[i]
+		}
+		s.known[i] = true
+	}
+}
+
+/*
+analyzeGcode reads the G-code of the file name and returns its bounding box,
+max temperatures, tools, extrusion and estimated print time. The bounding
+box of 3D printing only has extruding moves, so parking and purge travels
+do not count. Laser and CNC files count every G1/G2/G3 move.
+
+The time is estimated with the kinematics of model, or of the model in the
+slicer header if it comes before the first move. Heating and homing are not
+counted, like the slicers do.
+*/
+func analyzeGcode(r io.Reader, name, model string) (*gcodeStats, error) {
+	return scanGcode(r, name, model, nil)
+}
+
+// scanGcode is analyzeGcode that also calls draw, if not nil, with every
+// move of the bounding box.
+func scanGcode(r io.Reader, name, model string, draw func(from, to [3]float64)) (*gcodeStats, error) {
+	s := &gcodeStats{Nozzle: map[int]float64{}, Extrusion: map[int]float64{}}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".nc":
+		s.Module = "laser"
+	case ".cnc":
+		s.Module = "cnc"
+	default:
+		s.Module = "3dp"
+	}
+
+	var (
+		pos      [3]float64
+		known    [3]bool
+		e        float64
+		tool     int
+		feed     float64 // mm/s
+		relative bool    // G91
+		relE     bool    // M83
+		printing bool    // extruded since the start
+		layerZ   = math.Inf(-1)
+		zLayers  int
+		axes     = [3]byte{'X', 'Y', 'Z'}
+		pl       *planner
+	)
+	// the planner is created at the first move, the header may name the model
+	motion := func() *planner {
+		if pl == nil {
+			s.Kinematics = machineModel(model)
+			if s.Kinematics == "" {
+				s.Kinematics = machineModel(s.Model)
+			}
+			k, ok := machineKinematics[s.Kinematics]
+			if !ok {
+				s.Kinematics, k = "default", aSeriesKinematics
+			}
+			pl = newPlanner(k)
+		}
+		return pl
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		b, err := fix.ParseGcodeBlock(line)
+		if err == fix.ErrEmptyString {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if b.IsComment() {
+			s.header(b.Comment())
+			continue
+		}
+
+		cmd := b.Cmd()
+		switch {
+		case strings.HasPrefix(line, "SET_VELOCITY_LIMIT"):
+			setVelocityLimit(&motion().k, line)
+		case cmd.Word() == 'T':
+			var t int
+			if cmd.AddrAs(&t) == nil {
+				if t != tool && printing {
+					s.ToolChanges++
+				}
+				tool = t
+			}
+		case b.Is("G90"):
+			relative, relE = false, false
+		case b.Is("G91"):
+			relative, relE = true, true
+		case b.Is("M82"):
+			relE = false
+		case b.Is("M83"):
+			relE = true
+		case b.Is("G4"):
+			var v float32
+			if b.GetParam('P', &v) == nil {
+				motion().dwell(gcodeFloat(v) / 1000)
+			} else if b.GetParam('S', &v) == nil {
+				motion().dwell(gcodeFloat(v))
+			}
+		case b.Is("G28"):
+			motion().flush()
+			all := !b.HasParam('X') && !b.HasParam('Y') && !b.HasParam('Z')
+			for i, axis := range axes {
+				if all || b.HasParam(axis) {
+					pos[i], known[i] = 0, false
+				}
+			}
+		case b.Is("G92"):
+			for i, axis := range axes {
+				var v float32
+				if b.GetParam(axis, &v) == nil {
+					pos[i], known[i] = gcodeFloat(v), true
+				}
+			}
+			var v float32
+			if b.GetParam('E', &v) == nil {
+				e = gcodeFloat(v)
+			}
+		case b.Is("M104"), b.Is("M109"):
+			var t, temp float32
+			t = float32(tool)
+			b.GetParam('T', &t)
+			if b.GetParam('S', &temp) == nil || b.GetParam('R', &temp) == nil {
+				s.Nozzle[int(t)] = max(s.Nozzle[int(t)], gcodeFloat(temp))
+			}
+		case b.Is("M140"), b.Is("M190"):
+			var temp float32
+			if b.GetParam('S', &temp) == nil || b.GetParam('R', &temp) == nil {
+				s.Bed = max(s.Bed, gcodeFloat(temp))
+			}
+		case b.Is("M201"), b.Is("M203"):
+			k := &motion().k
+			limits := &k.MaxAccel
+			if b.Is("M203") {
+				limits = &k.MaxSpeed
+			}
+			for i, axis := range []byte{'X', 'Y', 'Z', 'E'} {
+				var v float32
+				if b.GetParam(axis, &v) == nil && v > 0 {
+					limits[i] = gcodeFloat(v)
+				}
+			}
+		case b.Is("M204"):
+			k := &motion().k
+			var v float32
+			if b.GetParam('S', &v) == nil && v > 0 {
+				k.Accel, k.Travel = gcodeFloat(v), gcodeFloat(v)
+			}
+			if b.GetParam('P', &v) == nil && v > 0 {
+				k.Accel = gcodeFloat(v)
+			}
+			if b.GetParam('T', &v) == nil && v > 0 {
+				k.Travel = gcodeFloat(v)
+			}
+			if b.GetParam('R', &v) == nil && v > 0 {
+				k.Retract = gcodeFloat(v)
+			}
+		case b.Is("M205"):
+			var v float32
+			if b.GetParam('J', &v) == nil && v > 0 {
+				motion().k.JunctionDeviation = gcodeFloat(v)
+			}
+		case b.Is("G0"), b.Is("G1"), b.Is("G2"), b.Is("G3"):
+			from, fromKnown := pos, known
+			for i, axis := range axes {
+				var v float32
+				if b.GetParam(axis, &v) != nil {
+					continue
+				}
+				if relative {
+					pos[i] += gcodeFloat(v)
+				} else {
+					pos[i], known[i] = gcodeFloat(v), true
+				}
+			}
+			var extruded float64
+			var v float32
+			if b.GetParam('E', &v) == nil {
+				if relE {
+					extruded = gcodeFloat(v)
+				} else {
+					extruded, e = gcodeFloat(v)-e, gcodeFloat(v)
+				}
+				s.Extrusion[tool] += extruded
+			}
+			if b.GetParam('F', &v) == nil && v > 0 {
+				feed = gcodeFloat(v) / 60
+			}
+
+			work := extruded > 0
+			if s.Module != "3dp" {
+				work = !b.Is("G0")
+			}
+			if work {
+				s.add(from, fromKnown)
+				s.add(pos, known)
+				if draw != nil {
+					draw(from, pos)
+				}
+			}
+			if extruded > 0 {
+				printing = true
+				if known[2] && pos[2] > layerZ+0.001 {
+					zLayers++
+					layerZ = pos[2]
+				}
+			}
+
+			var delta [3]float64
+			for i := range delta {
+				delta[i] = pos[i] - from[i]
+			}
+			length := math.Sqrt(delta[0]*delta[0] + delta[1]*delta[1] + delta[2]*delta[2])
+			if b.Is("G2") || b.Is("G3") {
+				length = arcLength(b, from, pos)
+			}
+			k := &motion().k
+			accel := k.Accel
+			if !work {
+				accel = k.Travel
+			}
+			motion().move(delta, length, extruded, feed, accel)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	motion().flush()
+	s.Time = math.Round(pl.time)
+
+	for t, mm := range s.Extrusion {
+		if mm > 0 {
+			s.Tools = append(s.Tools, t)
+			s.Extrusion[t] = math.Round(mm*100) / 100
+		} else {
+			delete(s.Extrusion, t)
+		}
+	}
+	slices.Sort(s.Tools)
+	for t, temp := range s.Nozzle {
+		if temp == 0 {
+			delete(s.Nozzle, t)
+		}
+	}
+	s.Layers = max(s.layerMarks[0], s.layerMarks[1])
+	if s.Layers == 0 {
+		s.Layers = zLayers
+	}
+	return s, nil
+}
+
+// arcLength returns the length of the G2/G3 arc b from from to to, the
+// center is given by I and J. Arcs given by R are counted as lines.
+func arcLength(b *fix.GcodeBlock, from, to [3]float64) float64 {
+	dz := to[2] - from[2]
+	var i, j float32
+	errI, errJ := b.GetParam('I', &i), b.GetParam('J', &j)
+	if errI != nil && errJ != nil {
+		return math.Hypot(math.Hypot(to[0]-from[0], to[1]-from[1]), dz)
+	}
+	cx, cy := from[0]+gcodeFloat(i), from[1]+gcodeFloat(j)
+	radius := math.Hypot(from[0]-cx, from[1]-cy)
+	start := math.Atan2(from[1]-cy, from[0]-cx)
+	end := math.Atan2(to[1]-cy, to[0]-cx)
+	sweep := end - start // counterclockwise, G3
+	if b.Is("G2") {
+		sweep = -sweep
+	}
+	if sweep <= 1e-9 {
+		sweep += 2 * math.Pi // a full circle if the arc ends where it starts
+	}
+	return math.Hypot(radius*sweep, dz)
+}
+
+// setVelocityLimit applies SET_VELOCITY_LIMIT of Klipper to k.
+func setVelocityLimit(k *kinematics, line string) {
+	for _, field := range strings.Fields(line)[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || v <= 0 {
+			continue
+		}
+		switch strings.ToUpper(key) {
+		case "VELOCITY":
+			k.MaxSpeed[0], k.MaxSpeed[1] = v, v
+		case "ACCEL":
+			k.Accel, k.Travel = v, v
+		case "SQUARE_CORNER_VELOCITY":
+			k.JunctionDeviation = v * v * (math.Sqrt2 - 1) / k.Accel
+		}
+	}
+}
+
+// header reads the module, the model, the filament and the estimates from
+// the comments of the slicers.
+func (s *gcodeStats) header(comment string) {
+	c := strings.TrimSpace(strings.TrimLeft(comment, ";"))
+	if c == "LAYER_CHANGE" {
+		s.layerMarks[0]++
+		return
+	}
+	// ; model printing time: 1h 2m 3s; total estimated time: 1h 5m 0s
+	if _, v, ok := strings.Cut(c, "total estimated time:"); ok {
+		s.SlicerTime = slicerDuration(v)
+		return
+	}
+	if k, v, ok := strings.Cut(c, ":"); ok {
+		v = strings.TrimSpace(v)
+		switch strings.TrimSpace(k) {
+		case "header_type":
+			if v == "laser" || v == "cnc" || v == "3dp" {
+				s.Module = v
+			}
+		case "tool_head":
+			s.dual = strings.Contains(strings.ToLower(v), "dual")
+		case "machine", "Printer":
+			if s.Model == "" {
+				s.Model = v
+			}
+		case "LAYER":
+			s.layerMarks[1]++
+		case "TIME", "PRINT.TIME", "estimated_time(s)":
+			if t, err := strconv.ParseFloat(v, 64); err == nil {
+				s.SlicerTime = t
+			}
+		case "Filament used": // Cura, in meters
+			s.SlicerFilament = slicerFloats(v, "m", 1000)
+		}
+	}
+	if k, v, ok := strings.Cut(c, "="); ok {
+		v = strings.TrimSpace(v)
+		switch strings.TrimSpace(k) {
+		case "printer_model":
+			if s.Model == "" {
+				s.Model = v
+			}
+		case "estimated printing time (normal mode)":
+			s.SlicerTime = slicerDuration(v)
+		case "filament used [mm]":
+			s.SlicerFilament = slicerFloats(v, "", 1)
+		case "filament_diameter":
+			s.diameter = slicerFloats(v, "", 1)
+		case "filament_density":
+			s.density = slicerFloats(v, "", 1)
+		}
+	}
+}
+
+// slicerFloats parses a list like "1.2, 3.4" or "1.2m;3.4m" and scales the
+// values, a value that does not parse is 0.
+func slicerFloats(v, unit string, scale float64) []float64 {
+	fields := strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ';' })
+	values := make([]float64, len(fields))
+	for i, f := range fields {
+		x, _ := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(f), unit), 64)
+		values[i] = x * scale
+	}
+	return values
+}
+
+// slicerDuration parses a time like "1d 2h 3m 4s" in seconds.
+func slicerDuration(v string) float64 {
+	var total float64
+	for _, f := range strings.Fields(v) {
+		if len(f) < 2 {
+			continue
+		}
+		x, err := strconv.ParseFloat(f[:len(f)-1], 64)
+		if err != nil {
+			continue
+		}
+		switch f[len(f)-1] {
+		case 'd':
+			total += x * 86400
+		case 'h':
+			total += x * 3600
+		case 'm':
+			total += x * 60
+		case 's':
+			total += x
+		}
+	}
+	return total
+}
+
+// analyzeWhileSending analyzes the file of p while the upload reads it,
+// wait returns the result once the upload has finished, nil if the file
+// can not be analyzed.
+func analyzeWhileSending(p *Payload, model string) (wait func() *gcodeStats) {
+	pr, pw := io.Pipe()
+	p.File = io.TeeReader(p.File, pw)
+	result := make(chan *gcodeStats, 1)
+	go func() {
+		s, err := analyzeGcode(pr, p.Name, model)
+		if err != nil {
+			p.log(logPreflight).Debug("Can not analyze", "file", p.Name, "err", err)
+			s = nil
+		}
+		io.Copy(io.Discard, pr) // the upload goes on
+		result <- s
+	}()
+	return func() *gcodeStats {
+		pw.Close()
+		return <-result
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	octoPrintService = "_octoprint._tcp"
+	mdnsDomain       = "local."
+)
+
+var MDNSAnnounce bool
+
+// octoPrintAnnouncer keeps a mDNS registration of the OctoPrint server for
+// every printer, the registration of a printer points the slicer to its
+// OctoPrint API under /printers/<id>/.
+type octoPrintAnnouncer struct {
+	b    *bridge
+	host string
+	ip   net.IP // nil to register on all interfaces
+	port int
+
+	mu      sync.Mutex
+	servers map[string]*zeroconf.Server // by printer key
+}
+
+// announceOctoPrint registers the OctoPrint server via mDNS for the default
+// printer and the known hosts, so that slicers can browse for them. With the
+// background discovery running, printers are added and withdrawn as they go
+// online and offline. shutdown withdraws all registrations.
+func announceOctoPrint(listenAddr string, b *bridge) (shutdown func(), err error) {
+	host, portStr, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("can not announce port '%s'", portStr)
+	}
+	a := &octoPrintAnnouncer{b: b, host: host, port: port, servers: map[string]*zeroconf.Server{}}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil, fmt.Errorf("%s is only reachable from this computer", listenAddr)
+	} else if ip != nil && !ip.IsUnspecified() {
+		a.ip = ip
+	}
+
+	if err := a.register(b.printer); err != nil {
+		return nil, err
+	}
+	for _, p := range b.ls.List() {
+		if err := a.register(p); err != nil {
+			logOctoPrint.Warn("Not announced via mDNS", "printer", printerKey(p), "err", err)
+		}
+	}
+
+	done, unsubscribe := make(chan empty), func() {}
+	if Registry != nil {
+		var events <-chan PrinterEvent
+		events, unsubscribe = Registry.Subscribe()
+		go a.follow(events, done)
+	}
+	return func() {
+		unsubscribe()
+		close(done)
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		for key, server := range a.servers {
+			server.Shutdown()
+			delete(a.servers, key)
+		}
+	}, nil
+}
+
+// follow updates the registrations with the events of the discovery.
+func (a *octoPrintAnnouncer) follow(events <-chan PrinterEvent, done <-chan empty) {
+	for {
+		select {
+		case e := <-events:
+			p := a.b.ls.Get(e.Printer)
+			switch {
+			case p == nil:
+			case e.Type == PrinterDisappeared:
+				a.withdraw(p)
+			default:
+				if err := a.register(p); err != nil {
+					logOctoPrint.Warn("Not announced via mDNS", "printer", printerKey(p), "err", err)
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// register announces the OctoPrint API of p, unless it is announced already.
+// The default printer is served under / as well, its registration points
+// there.
+func (a *octoPrintAnnouncer) register(p *Printer) error {
+	key := printerKey(p)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.servers[key]; ok {
+		return nil
+	}
+
+	path := "/printers/" + url.PathEscape(key) + "/"
+	if key == printerKey(a.b.printer) {
+		path = "/"
+	}
+	instance := "sm2uploader " + key
+	text := []string{
+		"path=" + path,
+		"version=" + octoPrintServerVersion,
+		"api=" + octoPrintAPIVersion,
+		"model=" + p.Model,
+		"vendor=Snapmaker",
+	}
+
+	var (
+		server *zeroconf.Server
+		err    error
+	)
+	if a.ip == nil {
+		server, err = zeroconf.Register(instance, octoPrintService, mdnsDomain, a.port, text, nil)
+	} else {
+		hostname := "sm2uploader-" + strings.Map(func(r rune) rune {
+			if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+				return '-'
+			}
+			return r
+		}, key)
+		server, err = zeroconf.RegisterProxy(instance, octoPrintService, mdnsDomain, a.port, hostname, []string{a.host}, text, nil)
+	}
+	if err != nil {
+		return err
+	}
+	a.servers[key] = server
+	logOctoPrint.Info("Announced via mDNS", "instance", instance, "service", octoPrintService+"."+mdnsDomain, "path", path)
+	return nil
+}
+
+// withdraw removes the registration of p, the default printer stays.
+func (a *octoPrintAnnouncer) withdraw(p *Printer) {
+	key := printerKey(p)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if server, ok := a.servers[key]; ok && key != printerKey(a.b.printer) {
+		server.Shutdown()
+		delete(a.servers, key)
+		logOctoPrint.Info("Withdrawn from mDNS", "instance", "sm2uploader "+key)
+	}
+}
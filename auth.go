@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// APIKey grants access to the bridge. With keys configured, X-Api-Key is
+// "<key>" or "<key>;<smfix switches>", the switches may also be sent in the
+// X-SMFix header.
+type APIKey struct {
+	User     string   `yaml:"user"`
+	Key      string   `yaml:"key"`
+	Printers []string `yaml:"printers,omitempty"` // printer ids/ips, empty for all
+}
+
+type apiKeyCtx struct{}
+
+var (
+	errAPIKeyMissing = errors.New("No API key provided")
+	errAPIKeyInvalid = errors.New("Invalid API key")
+)
+
+/*
+loadAPIKeys reads the keys from a YAML file:
+
+	keys:
+	  - user: alice
+	    key: 4f1c...
+	    printers: [J1V19, 192.168.1.20]
+*/
+func loadAPIKeys(path string) ([]*APIKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Keys []*APIKey `yaml:"keys"`
+	}
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, k := range file.Keys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("%s: key #%d of user '%s' is empty", path, i+1, k.User)
+		}
+	}
+	return file.Keys, nil
+}
+
+// loadAuth configures the API keys from a keys file and/or a single key
+// that is valid for all printers. No keys disables authentication.
+func (b *bridge) loadAuth(keysFile string, key string) error {
+	if keysFile != "" {
+		keys, err := loadAPIKeys(keysFile)
+		if err != nil {
+			return err
+		}
+		b.keys = append(b.keys, keys...)
+	}
+	if key != "" {
+		b.keys = append(b.keys, &APIKey{User: "default", Key: key})
+	}
+	return nil
+}
+
+// requireAPIKey rejects requests without a valid API key, the key is read
+// from X-Api-Key or the apikey query parameter (for EventSource).
+func (b *bridge) requireAPIKey(next http.Handler) http.Handler {
+	if len(b.keys) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := b.authenticate(r)
+		if err == errAPIKeyMissing {
+			octoPrintError(w, http.StatusUnauthorized, err.Error())
+			return
+		} else if err != nil {
+			octoPrintError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyCtx{}, key)))
+	})
+}
+
+func (b *bridge) authenticate(r *http.Request) (*APIKey, error) {
+	value := r.Header.Get("X-Api-Key")
+	if value == "" {
+		value = r.URL.Query().Get("apikey")
+	}
+	secret, _, _ := strings.Cut(value, ";")
+	if secret == "" {
+		return nil, errAPIKeyMissing
+	}
+	for _, k := range b.keys {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(k.Key)) == 1 {
+			return k, nil
+		}
+	}
+	return nil, errAPIKeyInvalid
+}
+
+// permits reports whether the key of the request may use printer.
+func permits(r *http.Request, printer *Printer) bool {
+	key, _ := r.Context().Value(apiKeyCtx{}).(*APIKey)
+	if key == nil || len(key.Printers) == 0 {
+		return true
+	}
+	for _, p := range key.Printers {
+		if strings.EqualFold(p, printer.ID) || p == printer.IP {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed writes a 403 response and returns false if the key of the request
+// may not use printer.
+func (b *bridge) allowed(w http.ResponseWriter, r *http.Request, printer *Printer) bool {
+	if permits(r, printer) {
+		return true
+	}
+	key := r.Context().Value(apiKeyCtx{}).(*APIKey)
+	octoPrintError(w, http.StatusForbidden, fmt.Sprintf("User '%s' is not allowed to use printer %s", key.User, printerKey(printer)))
+	return false
+}
+
+// smfixSwitches returns the SMFix switches of the request. Without API keys
+// configured the whole X-Api-Key is a bag of switches.
+func (b *bridge) smfixSwitches(r *http.Request) string {
+	switches := r.Header.Get("X-Api-Key")
+	if len(b.keys) > 0 {
+		_, switches, _ = strings.Cut(switches, ";")
+	}
+	if h := r.Header.Get("X-SMFix"); h != "" {
+		switches += ";" + h
+	}
+	return testUserAgent(r.Header.Get("User-Agent"), switches)
+}
+
+// octoPrintError writes an error the way OctoPrint does.
+func octoPrintError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// printerCtx is the context key of the printer of a request to
+// /printers/<id>/, see target.
+type printerCtx struct{}
+
+// bridge forwards the files received by the emulated servers (OctoPrint,
+// Moonraker) to the printers, all servers share the same statistics.
+type bridge struct {
+	printer *Printer // default printer
+	ls      *LocalStorage
+	stats   *stats
+	files   *octoPrintFiles // uploaded files, for the OctoPrint file list
+	keys    []*APIKey       // no authentication if empty
+	tls     *tls.Config     // nil for plain http
+}
+
+func newBridge(printer *Printer, ls *LocalStorage) *bridge {
+	return &bridge{
+		printer: printer,
+		ls:      ls,
+		files:   &octoPrintFiles{},
+		stats: &stats{
+			start:   time.Now(),
+			success: 0,
+			failure: 0,
+			lastSuccess: &last{
+				filaname: "",
+				size:     0,
+				time:     time.Now(),
+			},
+			lastFailure: &last{
+				filaname: "",
+				size:     0,
+				time:     time.Now(),
+			},
+		},
+	}
+}
+
+// lookup returns the default printer or the known printer of key (ID, IP or
+// alias), nil if there is none.
+func (b *bridge) lookup(key string) *Printer {
+	if key == printerKey(b.printer) {
+		return b.printer
+	}
+	return b.ls.Find(key)
+}
+
+// target returns the printer of a request to /printers/<id>/, the default
+// printer for the other requests.
+func (b *bridge) target(r *http.Request) *Printer {
+	if p, ok := r.Context().Value(printerCtx{}).(*Printer); ok {
+		return p
+	}
+	return b.printer
+}
+
+// upload applies the profile of printer and the SMFix switches in apiKey to
+// the payload and sends it to printer. The settings of the upload are its
+// own, the globals set by the flags are not changed. The log of the upload
+// has the ID of the request of ctx.
+func (b *bridge) upload(ctx context.Context, printer *Printer, payload *Payload, apiKey string) error {
+	payload.requestID = requestID(ctx)
+	log := payload.log(slog.Default())
+	set := applyProfile(printer)
+	payload.Fix = set.fixOptions()
+	if len(apiKey) > 5 {
+		payload.Fix = payload.Fix.withSwitches(apiKey)
+		payload.log(logSMFix).Info("SMFix switches of the request", "file", payload.Name, "nofix", payload.Fix.NoFix, "fix", payload.Fix)
+	}
+	payload.Print = payload.Print || set.print
+
+	if err := preflight(printer, payload); err != nil {
+		b.stats.addFailure(payload.Name, payload.Size)
+		return err
+	}
+
+	if set.preheating() && !DryRun {
+		log.Info("Preheating...", "printer", printerKey(printer))
+		if err := Connector.PreHeatCommands(printer, set.tool1, set.tool2, set.bed, set.home); err != nil {
+			log.Warn("Preheat failed", "printer", printerKey(printer), "err", err)
+		}
+	}
+
+	// Moonraker/Klipper devices don't need G-Code fix
+	if printer.Moonraker && !payload.Fix.NoFix {
+		payload.Fix.NoFix = true
+		log.Info("Moonraker device detected, skipping G-Code fix", "file", payload.Name)
+	}
+
+	// the analysis of preflight, or one while the stream is read to be
+	// saved or sent
+	var analysis func() *gcodeStats
+	if payload.analysis == nil && isGcodeFile(payload.Name) {
+		analysis = analyzeWhileSending(payload, printer.Model)
+	}
+
+	// If output directory is specified and the file needs fixing,
+	// pre-process it and save both original and fixed files to disk.
+	if set.output != "" && payload.ShouldBeFix() && !payload.Fix.NoFix {
+		payload.printer = printer
+		payload.publish(PhaseFixing, 0, payload.Size)
+		origContent, readErr := io.ReadAll(payload.File)
+		if readErr != nil {
+			log.Warn("Failed to read the file for output", "file", payload.Name, "err", readErr)
+		} else {
+			fixedContent, procErr := postProcess(bytes.NewReader(origContent), printer.Model, payload.Fix, payload.log(logSMFix))
+			if procErr != nil {
+				log.Warn("Failed to post-process the file for output", "file", payload.Name, "err", procErr)
+			} else {
+				fixedPath, saveErr := saveToOutputDir(set.output, payload.Name, bytes.NewReader(origContent), fixedContent, true)
+				if saveErr != nil {
+					log.Warn("Failed to save to output dir", "err", saveErr)
+				} else if fixedPath != "" {
+					payload.FixedFile = fixedPath
+					payload.Size = int64(len(fixedContent))
+					log.Info("Saved original and fixed file", "original", filepath.Join(set.output, payload.Name), "fixed", fixedPath)
+				}
+			}
+		}
+	} else if set.output != "" {
+		log.Info("Skipping output save", "file", payload.Name, "shouldFix", payload.ShouldBeFix(), "nofix", payload.Fix.NoFix)
+	}
+
+	send := Connector.Upload
+	if DryRun {
+		send = dryRun
+	}
+	err := send(printer, payload)
+	if analysis != nil {
+		if payload.analysis = analysis(); err == nil {
+			checkSent(printer, payload)
+		}
+	}
+	if err != nil {
+		b.stats.addFailure(payload.Name, payload.Size)
+		return err
+	}
+
+	b.stats.addSuccess(payload.Name, payload.Size)
+	b.files.add(payload)
+	if DryRun {
+		return nil
+	}
+
+	log.Info("Upload finished", "file", payload.Name, "size", payload.ReadableSize(), "printer", printerKey(printer))
+	return nil
+}
+
+// serve listens on listenAddr and serves handler until it fails, the
+// requests are logged to logger.
+func (b *bridge) serve(listenAddr string, handler http.Handler, logger *slog.Logger) error {
+	// Create a listener
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+
+	scheme := "http"
+	if b.tls != nil {
+		listener = tls.NewListener(listener, b.tls)
+		scheme = "https"
+	}
+
+	logger.Info("Server started, now you can upload files to " + scheme + "://" + listener.Addr().String())
+	// Start the server
+	return http.Serve(listener, LoggingMiddleware(handler, logger))
+}
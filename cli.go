@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/manifoldco/promptui"
+)
+
+// Exit codes of the commands, see doc.go.
+const (
+	exitOK              = 0
+	exitError           = 1
+	exitInvalidInput    = 2
+	exitPrinterNotFound = 3
+	exitAuthDenied      = 4
+	exitTransferFailed  = 5
+	exitFixFailed       = 6
+	exitPreflightFailed = 7
+)
+
+var (
+	errInvalidInput   = errors.New("invalid input")
+	errTransferFailed = errors.New("transfer failed")
+)
+
+func invalidInput(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", errInvalidInput, fmt.Sprintf(format, a...))
+}
+
+// exitCode returns the exit code of err.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errInvalidInput), errors.Is(err, errFileEmpty), errors.Is(err, errFileTooLarge):
+		return exitInvalidInput
+	case errors.Is(err, errPrinterNotFound):
+		return exitPrinterNotFound
+	case errors.Is(err, errAuthDenied):
+		return exitAuthDenied
+	case errors.Is(err, errFixFailed):
+		return exitFixFailed
+	case errors.Is(err, errPreflightFailed):
+		return exitPreflightFailed
+	case errors.Is(err, errTransferFailed):
+		return exitTransferFailed
+	}
+	return exitError
+}
+
+// transferError marks the errors of an upload that have no other exit code.
+func transferError(err error) error {
+	if exitCode(err) != exitError {
+		return err
+	}
+	return fmt.Errorf("%w: %w", errTransferFailed, err)
+}
+
+// fail reports err, as JSON with -json, and returns its exit code.
+func fail(err error) int {
+	code := exitCode(err)
+	if JSONOutput {
+		printJSON(struct {
+			Error string `json:"error"`
+			Code  int    `json:"code"`
+		}{err.Error(), code})
+	} else {
+		slog.Error(err.Error())
+	}
+	return code
+}
+
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// parseOptions parses the options of the upload, preheat, home, status and
+// serve commands and applies the config file.
+func parseOptions(args []string) error {
+	defineFlags()
+	flag.Usage = flag_usage
+	flag.CommandLine.Parse(args)
+	if err := loadConfig(flag.CommandLine, ConfigFile, true); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidInput, err)
+	}
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	Host = normalizeHost(Host)
+	saveBaseSettings()
+
+	slog.Debug("Debug mode", "version", Version)
+	return nil
+}
+
+// session holds the known hosts and the printer of a command.
+type session struct {
+	ls       *LocalStorage
+	printer  *Printer
+	settings uploadSettings // with the profile of printer
+}
+
+// openSession loads the known hosts and finds the printer. The known hosts
+// are saved by close, or when a signal stops the program.
+func openSession() (*session, error) {
+	ls, err := NewLocalStorage(KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{ls: ls}
+	if s.printer, err = s.findPrinter(); err != nil {
+		s.close()
+		return nil, err
+	}
+
+	if s.printer.Model != "" {
+		slog.Info("Printer", "ip", s.printer.IP, "model", s.printer.Model)
+	} else {
+		slog.Info("Printer", "ip", s.printer.IP)
+	}
+
+	s.settings = applyProfile(s.printer)
+
+	if s.settings.nofix {
+		slog.Warn("!! smfix has been disabled")
+	}
+
+	if s.settings.output != "" {
+		slog.Info("Output dir", "dir", s.settings.output)
+	}
+
+	// Moonraker/Klipper devices don't need G-Code fix
+	if s.printer.Moonraker {
+		s.settings.nofix = true
+		slog.Info("!! Moonraker device detected, smfix disabled")
+	}
+
+	// Create a channel to listen for signals
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		sig := <-sc
+		slog.Info("Received signal", "signal", sig)
+		s.close()
+		runAtExit()
+		// like a shell: 130 for SIGINT, 143 for SIGTERM
+		code := exitError
+		if n, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(n)
+		}
+		os.Exit(code)
+	}()
+
+	return s, nil
+}
+
+// findPrinter returns the printer of -host, or the discovered printer. The
+// user chooses if several printers are found.
+func (s *session) findPrinter() (*Printer, error) {
+	ls := s.ls
+
+	// Check if host is specified
+	printer := ls.Find(Host)
+	if printer != nil {
+		slog.Info("Found printer in known hosts", "printer", printer.String(), "file", KnownHosts)
+		return printer, nil
+	}
+
+	// Discover printers
+	logDiscovery.Info("Discovering ...")
+	printers, err := Discover(DiscoverTimeout)
+	if err == nil {
+		logDiscovery.Debug("Discovered", "printers", len(printers))
+		ls.Add(printers...)
+	} else {
+		logDiscovery.Debug("Discover error", "err", err)
+	}
+
+	// broadcast and multicast may be blocked, ask every address instead
+	var subnets []string
+	if ScanCIDRs != "" {
+		subnets = strings.Split(ScanCIDRs, ",")
+	} else if len(printers) == 0 && ls.Find(Host) == nil {
+		subnets = localSubnets()
+	}
+	if len(subnets) > 0 {
+		if printers, err := Scan(subnets, DiscoverTimeout); err == nil {
+			logDiscovery.Info("Scan finished", "printers", len(printers))
+			ls.Add(printers...)
+		} else {
+			logDiscovery.Warn("Scan error", "err", err)
+		}
+	}
+	if printer = ls.Find(Host); printer != nil {
+		slog.Info("Found printer", "printer", printer.String())
+		return printer, nil
+	}
+
+	if Host != "" {
+		// directly to printer using ip/hostname
+		return &Printer{IP: Host}, nil
+	}
+
+	// Prompt user to select a printer
+	printers = ls.List()
+	switch {
+	case len(printers) == 0:
+		return nil, fmt.Errorf("%w: no printers found", errPrinterNotFound)
+	case len(printers) == 1:
+		return printers[0], nil
+	case JSONOutput:
+		return nil, invalidInput("%d printers found, choose one with -host", len(printers))
+	}
+	prompt := promptui.Select{
+		Label: "Select a printer",
+		Items: printers,
+	}
+	idx, _, err := prompt.Run()
+	if err != nil {
+		return nil, err
+	}
+	return printers[idx], nil
+}
+
+// close saves the known hosts, the printer may have a new token.
+func (s *session) close() {
+	if s.printer != nil {
+		s.ls.Add(s.printer)
+		slog.Debug("Updated printer", "printer", s.printer.String())
+	}
+	if err := s.ls.Save(); err != nil {
+		slog.Error("Error saving known hosts", "err", err)
+	} else {
+		slog.Debug("Saved known hosts", "file", KnownHosts)
+	}
+}
+
+// runDefault implements "sm2uploader [options] file ...", it uploads the
+// files, or serves if a server address is given.
+func runDefault(args []string) int {
+	if err := parseOptions(args); err != nil {
+		return fail(err)
+	}
+	if OctoPrintListenAddr != "" || MoonrakerListenAddr != "" || PrusaLinkListenAddr != "" {
+		return serve()
+	}
+	return upload(flag.Args())
+}
+
+// runUpload implements "sm2uploader upload [options] file ...".
+func runUpload(args []string) int {
+	if err := parseOptions(args); err != nil {
+		return fail(err)
+	}
+	return upload(flag.Args())
+}
+
+// runServe implements "sm2uploader serve [options]".
+func runServe(args []string) int {
+	if err := parseOptions(args); err != nil {
+		return fail(err)
+	}
+	if OctoPrintListenAddr == "" && MoonrakerListenAddr == "" && PrusaLinkListenAddr == "" {
+		return fail(invalidInput("no server address, use -octoprint, -moonraker-listen or -prusalink-listen"))
+	}
+	return serve()
+}
+
+// runPreheat implements "sm2uploader preheat [-tool1 T] [-tool2 T] [-bed T] [-home]".
+func runPreheat(args []string) int {
+	if err := parseOptions(args); err != nil {
+		return fail(err)
+	}
+	s, err := openSession()
+	if err != nil {
+		return fail(err)
+	}
+	defer s.close()
+
+	set := s.settings
+	if !set.preheating() {
+		return fail(invalidInput("no temperatures, use -tool1, -tool2 or -bed"))
+	}
+	return s.preheat(set.tool1, set.tool2, set.bed, set.home)
+}
+
+// runHome implements "sm2uploader home [options]".
+func runHome(args []string) int {
+	if err := parseOptions(args); err != nil {
+		return fail(err)
+	}
+	s, err := openSession()
+	if err != nil {
+		return fail(err)
+	}
+	defer s.close()
+	return s.preheat(0, 0, 0, true)
+}
+
+func (s *session) preheat(tool1, tool2, bed int, home bool) int {
+	slog.Info("Preheating...", "printer", printerKey(s.printer))
+	if err := Connector.PreHeatCommands(s.printer, tool1, tool2, bed, home); err != nil {
+		return fail(err)
+	}
+	if JSONOutput {
+		printJSON(struct {
+			Printer string `json:"printer"`
+			Tool1   int    `json:"tool1"`
+			Tool2   int    `json:"tool2"`
+			Bed     int    `json:"bed"`
+			Home    bool   `json:"home"`
+		}{printerKey(s.printer), tool1, tool2, bed, home})
+	}
+	return exitOK
+}
+
+// runStatus implements "sm2uploader status [options]".
+func runStatus(args []string) int {
+	if err := parseOptions(args); err != nil {
+		return fail(err)
+	}
+	s, err := openSession()
+	if err != nil {
+		return fail(err)
+	}
+	defer s.close()
+
+	status, err := Connector.Status(s.printer)
+	if err != nil {
+		return fail(err)
+	}
+	if JSONOutput {
+		printJSON(struct {
+			Printer  string `json:"printer"`
+			IP       string `json:"ip"`
+			Model    string `json:"model,omitempty"`
+			Protocol string `json:"protocol"`
+			*PrinterStatus
+		}{printerKey(s.printer), s.printer.IP, s.printer.Model, s.printer.Protocol(), status})
+		return exitOK
+	}
+
+	fmt.Printf("Printer:  %s (%s)\n", s.printer.String(), s.printer.Protocol())
+	fmt.Printf("State:    %s\n", status.State)
+	if status.File != "" {
+		fmt.Printf("File:     %s\n", status.File)
+		fmt.Printf("Progress: %.1f%%\n", status.Progress*100)
+	}
+	for i, t := range status.Nozzles {
+		fmt.Printf("Nozzle %d: %.1f / %.1f °C\n", i+1, t.Actual, t.Target)
+	}
+	if status.Bed != nil {
+		fmt.Printf("Bed:      %.1f / %.1f °C\n", status.Bed.Actual, status.Bed.Target)
+	}
+	return exitOK
+}
+
+// uploadResult is the -json output of an upload.
+type uploadResult struct {
+	File    string `json:"file"`
+	Size    int64  `json:"size"`
+	Printer string `json:"printer"`
+	Print   bool   `json:"print"`
+	DryRun  bool   `json:"dry_run,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// upload preheats the printer if asked to and uploads files, it stops at
+// the first failure.
+func upload(files []string) int {
+	// check the arguments before looking for the printer, the profile of
+	// the printer is checked below
+	if len(files) == 0 && !baseSettings.preheating() {
+		return fail(invalidInput("no input files"))
+	}
+	var payloads []*Payload
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return fail(invalidInput("%s", err))
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return fail(invalidInput("%s", err))
+		}
+		payloads = append(payloads, NewPayload(f, st.Name(), st.Size()))
+	}
+
+	s, err := openSession()
+	if err != nil {
+		return fail(err)
+	}
+	defer s.close()
+	printer, set := s.printer, s.settings
+
+	preheating := set.preheating()
+	if len(payloads) == 0 && !preheating {
+		return fail(invalidInput("no input files"))
+	}
+	// refuse the files that do not fit before the printer heats up
+	for _, p := range payloads {
+		if err := preflight(printer, p); err != nil {
+			return fail(err)
+		}
+	}
+	if preheating && DryRun {
+		slog.Info("Dry run, not preheating", "printer", printerKey(printer))
+	} else if preheating {
+		slog.Info("Preheating...", "printer", printerKey(printer))
+		if err := Connector.PreHeatCommands(printer, set.tool1, set.tool2, set.bed, set.home); err != nil {
+			return fail(err)
+		}
+	}
+
+	// 从 slic3r 环境变量中获取文件名
+	envFilename := os.Getenv("SLIC3R_PP_OUTPUT_NAME")
+
+	// Upload files to host
+	send := Connector.Upload
+	if DryRun {
+		send = dryRun
+	}
+	results := []*uploadResult{}
+	for _, p := range payloads {
+		if envFilename != "" {
+			p.SetName(filepath.Base(envFilename))
+		}
+		p.Print = set.print
+		p.Fix = set.fixOptions()
+
+		// If output directory is specified and the file needs fixing,
+		// pre-process it and save both original and fixed files to disk.
+		// Then set FixedFile so StreamContent can stream from disk instead
+		// of holding the entire content in memory.
+		if set.output != "" && p.ShouldBeFix() && !p.Fix.NoFix {
+			// Read original content first (we need to save it before postProcess consumes the reader)
+			origContent, readErr := io.ReadAll(p.File)
+			if readErr != nil {
+				slog.Warn("Failed to read the file for output", "file", p.Name, "err", readErr)
+			} else {
+				p.File = bytes.NewReader(origContent)
+				fixedContent, procErr := postProcess(bytes.NewReader(origContent), printer.Model, p.Fix, logSMFix)
+				if procErr != nil {
+					slog.Warn("Failed to post-process the file for output", "file", p.Name, "err", procErr)
+				} else {
+					fixedPath, saveErr := saveToOutputDir(set.output, p.Name, bytes.NewReader(origContent), fixedContent, false)
+					if saveErr != nil {
+						slog.Warn("Failed to save to output dir", "err", saveErr)
+					} else if fixedPath != "" {
+						p.FixedFile = fixedPath
+						p.Size = int64(len(fixedContent))
+						slog.Info("Saved fixed file", "file", fixedPath)
+					}
+				}
+			}
+		} else if set.output != "" {
+			slog.Info("Skipping output save", "file", p.Name, "shouldFix", p.ShouldBeFix(), "nofix", p.Fix.NoFix)
+		}
+
+		if !DryRun {
+			slog.Info("Uploading file", "file", p.Name, "size", p.ReadableSize())
+		}
+		result := &uploadResult{File: p.Name, Size: p.Size, Printer: printerKey(printer), Print: p.Print, DryRun: DryRun}
+		results = append(results, result)
+		if err := send(printer, p); err != nil {
+			err = transferError(err)
+			if !JSONOutput {
+				return fail(err)
+			}
+			result.Error = err.Error()
+			printJSON(results)
+			return exitCode(err)
+		}
+		result.Size = p.Size
+		if DryRun {
+			continue
+		}
+		slog.Info("Upload finished", "file", p.Name, "size", p.ReadableSize())
+		<-time.After(time.Second * 1) // HMI needs some time to refresh
+	}
+	if JSONOutput {
+		printJSON(results)
+	}
+	return exitOK
+}
+
+// serve runs the OctoPrint, Moonraker and PrusaLink servers until one fails.
+func serve() int {
+	s, err := openSession()
+	if err != nil {
+		return fail(err)
+	}
+	defer s.close()
+
+	// listen for octoprint/moonraker/prusalink uploads
+	// use the known hosts entry, its IP is kept up to date by the discovery
+	printer := s.printer
+	s.ls.Add(printer)
+	if p := s.ls.Get(printer.ID); printer.ID != "" && p != nil {
+		printer = p
+		s.printer = p
+	}
+	if DiscoverInterval > 0 {
+		Registry = newPrinterRegistry(s.ls, DiscoverInterval)
+		go Registry.run(context.Background())
+	}
+
+	b := newBridge(printer, s.ls)
+	if err := b.loadAuth(APIKeysFile, APIKeyValue); err != nil {
+		return fail(err)
+	}
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		return fail(err)
+	}
+	b.tls = tlsConfig
+	errc := make(chan error, 3)
+	if OctoPrintListenAddr != "" {
+		go func() { errc <- startOctoPrintServer(OctoPrintListenAddr, b) }()
+	}
+	if MoonrakerListenAddr != "" {
+		go func() { errc <- startMoonrakerServer(MoonrakerListenAddr, b) }()
+	}
+	if PrusaLinkListenAddr != "" {
+		go func() { errc <- startPrusaLinkServer(PrusaLinkListenAddr, b) }()
+	}
+	if err := <-errc; err != nil {
+		return fail(err)
+	}
+	return exitOK
+}
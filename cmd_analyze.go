@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// analyzeResult is the output of the analyze subcommand for a file.
+type analyzeResult struct {
+	File           string        `json:"file"`
+	Kinematics     string        `json:"kinematics"` // model of the motion limits
+	Time           float64       `json:"time"`       // estimated print time (s)
+	SlicerTime     float64       `json:"slicer_time,omitempty"`
+	Layers         int           `json:"layers"`
+	ToolChanges    int           `json:"tool_changes"`
+	Filament       []filamentUse `json:"filament"`
+	SlicerFilament []float64     `json:"slicer_filament,omitempty"` // mm by tool
+}
+
+type filamentUse struct {
+	Tool   int     `json:"tool"`
+	Length float64 `json:"length"` // mm
+	Volume float64 `json:"volume"` // cm³
+	Weight float64 `json:"weight"` // g
+}
+
+/*
+runAnalyze implements "sm2uploader analyze [-model M | -host H] <files>", it
+estimates the print time with the motion limits of the model and the
+filament by extruder, and compares them with the estimates of the slicer.
+Without a model, the printer named in the slicer header is used.
+*/
+func runAnalyze(args []string) int {
+	var (
+		fs       = flag.NewFlagSet("analyze", flag.ExitOnError)
+		model    = fs.String("model", "", "printer model, e.g. A350, J1, Artisan, U1")
+		host     = fs.String("host", os.Getenv("HOST"), "take the model of this known printer (ID, IP or alias)")
+		hostsYML = fs.String("knownhosts", defaultKnownHostsPath(), "known hosts")
+	)
+	fs.BoolVar(&JSONOutput, "json", false, "print JSON")
+	fs.BoolVar(&Debug, "debug", parseBoolEnv("DEBUG", false), "debug mode, same as -log-level debug")
+	logFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s analyze [-model M | -host H] [-json] <files>\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := loadConfig(fs, defaultConfigPath(), false); err != nil {
+		return fail(fmt.Errorf("%w: %w", errInvalidInput, err))
+	}
+	if err := setupLogging(); err != nil {
+		return fail(err)
+	}
+	if fs.NArg() == 0 {
+		return fail(invalidInput("no input files"))
+	}
+	printerModel, err := modelOf(*model, *host, *hostsYML)
+	if err != nil {
+		return fail(err)
+	}
+	if *model != "" && machineModel(*model) == "" {
+		return fail(invalidInput("unknown model '%s', use A150, A250, A350, Artisan, J1 or U1", *model))
+	}
+
+	results := []*analyzeResult{}
+	for _, file := range fs.Args() {
+		f, err := os.Open(file)
+		if err != nil {
+			return fail(invalidInput("%s", err))
+		}
+		s, err := analyzeGcode(f, file, printerModel)
+		f.Close()
+		if err != nil {
+			return fail(invalidInput("%s: %s", file, err))
+		}
+
+		r := &analyzeResult{
+			File:           file,
+			Kinematics:     s.Kinematics,
+			Time:           s.Time,
+			SlicerTime:     s.SlicerTime,
+			Layers:         s.Layers,
+			ToolChanges:    s.ToolChanges,
+			Filament:       []filamentUse{},
+			SlicerFilament: s.SlicerFilament,
+		}
+		for _, t := range s.Tools {
+			volume, weight := s.filament(t)
+			r.Filament = append(r.Filament, filamentUse{Tool: t, Length: s.Extrusion[t], Volume: volume, Weight: weight})
+		}
+		results = append(results, r)
+	}
+
+	if JSONOutput {
+		printJSON(results)
+		return exitOK
+	}
+	for _, r := range results {
+		fmt.Printf("%s (%s)\n", r.File, r.Kinematics)
+		fmt.Printf("  time          %s", formatSeconds(r.Time))
+		if r.SlicerTime > 0 {
+			fmt.Printf(" (slicer %s, %+.1f%%)", formatSeconds(r.SlicerTime), (r.Time-r.SlicerTime)/r.SlicerTime*100)
+		}
+		fmt.Println()
+		for _, u := range r.Filament {
+			fmt.Printf("  T%d            %.2f m, %.1f cm³, %.1f g", u.Tool, u.Length/1000, u.Volume, u.Weight)
+			if u.Tool < len(r.SlicerFilament) && r.SlicerFilament[u.Tool] > 0 {
+				fmt.Printf(" (slicer %.2f m)", r.SlicerFilament[u.Tool]/1000)
+			}
+			fmt.Println()
+		}
+		fmt.Printf("  layers        %d\n", r.Layers)
+		fmt.Printf("  tool changes  %d\n", r.ToolChanges)
+	}
+	return exitOK
+}
+
+// formatSeconds returns s like 1h2m3s.
+func formatSeconds(s float64) string {
+	return (time.Duration(s) * time.Second).Round(time.Second).String()
+}
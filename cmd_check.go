@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// checkResult is the output of the check subcommand for a file.
+type checkResult struct {
+	File     string      `json:"file"`
+	Model    string      `json:"model"`
+	Module   string      `json:"module"`
+	OK       bool        `json:"ok"`
+	Problems []string    `json:"problems,omitempty"`
+	Stats    *gcodeStats `json:"stats"`
+}
+
+/*
+runCheck implements "sm2uploader check [-model M | -host H] <files>", the
+preflight check without upload. The model is -model, the model of -host in
+the known hosts or the printer named in the slicer header of the file. It
+exits with exitPreflightFailed if a file does not fit.
+*/
+func runCheck(args []string) int {
+	var (
+		fs       = flag.NewFlagSet("check", flag.ExitOnError)
+		model    = fs.String("model", "", "printer model, e.g. A350, J1, Artisan, U1")
+		host     = fs.String("host", os.Getenv("HOST"), "take the model of this known printer (ID, IP or alias)")
+		hostsYML = fs.String("knownhosts", defaultKnownHostsPath(), "known hosts")
+	)
+	fs.BoolVar(&JSONOutput, "json", false, "print JSON")
+	fs.BoolVar(&Debug, "debug", parseBoolEnv("DEBUG", false), "debug mode, same as -log-level debug")
+	logFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check [-model M | -host H] [-json] <files>\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := loadConfig(fs, defaultConfigPath(), false); err != nil {
+		return fail(fmt.Errorf("%w: %w", errInvalidInput, err))
+	}
+	if err := setupLogging(); err != nil {
+		return fail(err)
+	}
+	if fs.NArg() == 0 {
+		return fail(invalidInput("no input files"))
+	}
+
+	printerModel, err := modelOf(*model, *host, *hostsYML)
+	if err != nil {
+		return fail(err)
+	}
+
+	code := exitOK
+	results := []*checkResult{}
+	for _, file := range fs.Args() {
+		f, err := os.Open(file)
+		if err != nil {
+			return fail(invalidInput("%s", err))
+		}
+		s, err := analyzeGcode(f, file, printerModel)
+		f.Close()
+		if err != nil {
+			return fail(invalidInput("%s: %s", file, err))
+		}
+
+		r := &checkResult{File: file, Model: printerModel, Module: s.Module, Stats: s}
+		if r.Model == "" {
+			r.Model = s.Model
+		}
+		m := machineModel(r.Model)
+		if m == "" {
+			return fail(invalidInput("%s: unknown model '%s', use -model", file, r.Model))
+		}
+		r.Model = m
+		r.Module, r.Problems = s.check(m)
+		r.OK = len(r.Problems) == 0
+		if !r.OK {
+			code = exitPreflightFailed
+		}
+		results = append(results, r)
+	}
+
+	if JSONOutput {
+		printJSON(results)
+		return code
+	}
+	for _, r := range results {
+		status := "OK"
+		if !r.OK {
+			status = "FAIL"
+		}
+		fmt.Printf("%s: %s (%s, %s)\n", r.File, status, r.Model, r.Module)
+		s := r.Stats
+		axes := []string{}
+		for i, axis := range []string{"X", "Y", "Z"} {
+			if s.known[i] {
+				axes = append(axes, fmt.Sprintf("%s %.1f..%.1f", axis, s.Min[i], s.Max[i]))
+			}
+		}
+		if len(axes) > 0 {
+			fmt.Printf("  bounds     %s mm\n", strings.Join(axes, ", "))
+		}
+		for _, t := range s.Tools {
+			fmt.Printf("  T%d         %.0f°C, %.1f mm filament\n", t, s.Nozzle[t], s.Extrusion[t])
+		}
+		if s.Bed > 0 {
+			fmt.Printf("  bed        %.0f°C\n", s.Bed)
+		}
+		for _, p := range r.Problems {
+			fmt.Printf("  problem    %s\n", p)
+		}
+	}
+	return code
+}
+
+// modelOf returns model, or the model of host in the known hosts, or "" if
+// both are empty and the files name the printer.
+func modelOf(model, host, hostsYML string) (string, error) {
+	if model != "" || host == "" {
+		return model, nil
+	}
+	ls, err := NewLocalStorage(hostsYML)
+	if err != nil {
+		return "", err
+	}
+	p := ls.Find(normalizeHost(host))
+	if p == nil {
+		return "", fmt.Errorf("%w: %s is not a known host", errPrinterNotFound, host)
+	}
+	return p.Model, nil
+}
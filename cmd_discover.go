@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// discoveredPrinter is the output of the discover subcommand.
+type discoveredPrinter struct {
+	ID        string            `json:"id"`
+	IP        string            `json:"ip"`
+	Model     string            `json:"model"`
+	Protocol  string            `json:"protocol"`
+	Sacp      bool              `json:"sacp"`
+	Moonraker bool              `json:"moonraker"`
+	Status    string            `json:"status,omitempty"`
+	Methods   []string          `json:"methods"`
+	Hostname  string            `json:"hostname,omitempty"`
+	Port      int               `json:"port,omitempty"`
+	Addresses []string          `json:"addresses,omitempty"`
+	TXT       map[string]string `json:"txt,omitempty"`
+}
+
+// runDiscover implements "sm2uploader discover", it lists the printers that
+// answer to UDP broadcast, mDNS and the optional subnet scan. If none answer
+// and there is no -scan, the local subnets are scanned. It exits with
+// exitPrinterNotFound if there are none.
+func runDiscover(args []string) int {
+	var (
+		fs       = flag.NewFlagSet("discover", flag.ExitOnError)
+		timeout  = fs.Duration("timeout", parseDurationEnv("TIMEOUT", 4*time.Second), "printer discovery timeout")
+		save     = fs.Bool("save", false, "add the printers to the known hosts")
+		scan     = fs.String("scan", os.Getenv("SCAN"), "also scan subnets (comma separated, e.g. 192.168.10.0/24)")
+		hostsYML = fs.String("knownhosts", defaultKnownHostsPath(), "known hosts")
+	)
+	fs.BoolVar(&JSONOutput, "json", false, "print JSON")
+	fs.BoolVar(&Debug, "debug", parseBoolEnv("DEBUG", false), "debug mode, same as -log-level debug")
+	logFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s discover [-timeout 4s] [-json] [-save] [-scan CIDR]\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := loadConfig(fs, defaultConfigPath(), false); err != nil {
+		return fail(fmt.Errorf("%w: %w", errInvalidInput, err))
+	}
+	if err := setupLogging(); err != nil {
+		return fail(err)
+	}
+
+	printers, err := Discover(*timeout)
+	if err != nil {
+		return fail(err)
+	}
+	if *scan != "" {
+		found, err := Scan(strings.Split(*scan, ","), *timeout)
+		if err != nil {
+			return fail(fmt.Errorf("%w: %w", errInvalidInput, err))
+		}
+		printers = append(printers, found...)
+	} else if len(printers) == 0 {
+		// broadcast and multicast may be blocked, ask every address instead
+		if found, err := Scan(localSubnets(), *timeout); err == nil {
+			logDiscovery.Info("Scan finished", "printers", len(found))
+			printers = found
+		} else {
+			logDiscovery.Warn("Scan error", "err", err)
+		}
+	}
+
+	result := mergeDiscovered(printers)
+
+	if *save {
+		ls, err := NewLocalStorage(*hostsYML)
+		if err != nil {
+			return fail(err)
+		}
+		ls.Add(printers...)
+		if err := ls.Save(); err != nil {
+			return fail(err)
+		}
+		slog.Info("Saved printers", "printers", len(result), "file", *hostsYML)
+	}
+
+	if JSONOutput {
+		printJSON(result)
+	} else if len(result) == 0 {
+		slog.Info("No printers found")
+	}
+	if len(result) == 0 {
+		return exitPrinterNotFound
+	} else if JSONOutput {
+		return exitOK
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tIP\tMODEL\tPROTOCOL\tSTATUS\tFOUND BY")
+	for _, p := range result {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", p.ID, p.IP, p.Model, p.Protocol, p.Status, strings.Join(p.Methods, ","))
+	}
+	w.Flush()
+	return exitOK
+}
+
+// mergeDiscovered merges the answers of the same printer, a printer is
+// often found on several interfaces and by several methods.
+func mergeDiscovered(printers []*Printer) []*discoveredPrinter {
+	var (
+		result = []*discoveredPrinter{}
+		byKey  = map[string]*discoveredPrinter{}
+	)
+	for _, p := range printers {
+		key := p.ID + "@" + p.IP
+		d, ok := byKey[key]
+		if !ok {
+			d = &discoveredPrinter{
+				ID:        p.ID,
+				IP:        p.IP,
+				Model:     p.Model,
+				Protocol:  p.Protocol(),
+				Sacp:      p.Sacp,
+				Moonraker: p.Moonraker,
+				Hostname:  p.Hostname,
+				Port:      p.Port,
+				Addresses: p.Addresses,
+				TXT:       p.TXT,
+			}
+			byKey[key] = d
+			result = append(result, d)
+		}
+		if p.Status != "" {
+			d.Status = p.Status
+		}
+		if p.Method != "" && !slices.Contains(d.Methods, p.Method) {
+			d.Methods = append(d.Methods, p.Method)
+		}
+	}
+	return result
+}
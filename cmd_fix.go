@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fixResult is the output of the fix subcommand for a file.
+type fixResult struct {
+	File  string `json:"file"`
+	Fixed string `json:"fixed"`
+	Diff  string `json:"diff"`
+	diffCount
+	Stages []stageChange `json:"stages"`
+}
+
+// stageChange is what a step of SMFix changed, see fixGcode.
+type stageChange struct {
+	Stage string `json:"stage"`
+	diffCount
+}
+
+/*
+runFix implements "sm2uploader fix [-output dir] <files>", it runs SMFix like
+an upload to a printer of -model (or -host) does and saves the fixed file
+and a unified diff against the original as <name>_fixed.gcode and
+<name>_fixed.diff. The summary shows the lines each stage inserted, removed
+and modified.
+*/
+func runFix(args []string) int {
+	var (
+		fs       = flag.NewFlagSet("fix", flag.ExitOnError)
+		output   = fs.String("output", os.Getenv("OUTPUT_DIR"), "directory of the fixed files and diffs, default: the directory of each file")
+		showDiff = fs.Bool("diff", false, "print the unified diff instead of the summary")
+		model    = fs.String("model", "", "printer model, e.g. A350, J1, Artisan, U1")
+		host     = fs.String("host", os.Getenv("HOST"), "take the model of this known printer (ID, IP or alias)")
+		hostsYML = fs.String("knownhosts", defaultKnownHostsPath(), "known hosts")
+	)
+	fixFlag(fs)
+	fs.BoolVar(&JSONOutput, "json", false, "print JSON")
+	fs.BoolVar(&Debug, "debug", parseBoolEnv("DEBUG", false), "debug mode, same as -log-level debug")
+	logFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s fix [-fix stages] [-model M | -host H] [-output dir] [-diff | -json] <files>\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := loadConfig(fs, defaultConfigPath(), false); err != nil {
+		return fail(fmt.Errorf("%w: %w", errInvalidInput, err))
+	}
+	if err := setupLogging(); err != nil {
+		return fail(err)
+	}
+	if fs.NArg() == 0 {
+		return fail(invalidInput("no input files"))
+	}
+	printerModel, err := modelOf(*model, *host, *hostsYML)
+	if err != nil {
+		return fail(err)
+	}
+
+	results := []*fixResult{}
+	for _, file := range fs.Args() {
+		if !shouldBeFix(file) {
+			return fail(invalidInput("%s: SMFix does not fix %s files, see extensions in the config", file, filepath.Ext(file)))
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fail(invalidInput("%s", err))
+		}
+
+		original := gcodeLines(data)
+		r := &fixResult{File: file, Stages: []stageChange{}}
+		prev := original
+		fixed, err := fixGcode(data, printerModel, SmFixOptions, logSMFix, func(stage string, lines []string) {
+			r.Stages = append(r.Stages, stageChange{Stage: stage, diffCount: countDiff(diffLines(prev, lines))})
+			prev = lines
+		})
+		if err != nil {
+			return fail(fmt.Errorf("%w: %s: %w", errFixFailed, file, err))
+		}
+		ops := diffLines(original, prev)
+		r.diffCount = countDiff(ops)
+
+		dir := *output
+		if dir == "" {
+			dir = filepath.Dir(file)
+		}
+		if r.Fixed, err = saveToOutputDir(dir, filepath.Base(file), nil, fixed, false); err != nil {
+			return fail(err)
+		}
+		r.Diff = strings.TrimSuffix(r.Fixed, filepath.Ext(r.Fixed)) + ".diff"
+		var diff bytes.Buffer
+		writeUnifiedDiff(&diff, filepath.Base(file), filepath.Base(r.Fixed), ops, 3)
+		if err := os.WriteFile(r.Diff, diff.Bytes(), 0644); err != nil {
+			return fail(err)
+		}
+		if *showDiff && !JSONOutput {
+			os.Stdout.Write(diff.Bytes())
+		}
+		results = append(results, r)
+	}
+
+	switch {
+	case JSONOutput:
+		printJSON(results)
+	case !*showDiff:
+		for _, r := range results {
+			fmt.Printf("%s -> %s (%s), diff %s\n", r.File, r.Fixed, r.diffCount, r.Diff)
+			for _, s := range r.Stages {
+				fmt.Printf("  %-14s %s\n", s.Stage, s.diffCount)
+			}
+		}
+	}
+	return exitOK
+}
+
+// gcodeLines splits data into lines like fixGcode reads them.
+func gcodeLines(data []byte) []string {
+	lines := []string{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	return lines
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const hostsUsage = `Usage: %[1]s hosts <command> [options] [args]
+
+Commands:
+  list                          list the known printers
+  add <ip>                      probe ip and add the printer
+  remove <host>                 remove a printer
+  rename <host> <alias>         set the alias of a printer, "" to clear it
+  set <host> <key=value> ...    set alias, ip, id, model, protocol (sacp/http/moonraker), token
+  rotate-token <host>           disconnect and authorize again (Snapmaker 2), tap Yes on the touchscreen
+  encrypt                       encrypt the tokens, the key is $TOKEN_KEY or a new key file next to the known hosts
+
+A host is an ID, IP, alias, or a unique ID prefix.
+`
+
+// runHosts implements "sm2uploader hosts", it manages the known hosts.
+func runHosts(args []string) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "help" {
+		fmt.Fprintf(os.Stderr, hostsUsage, os.Args[0])
+		return exitInvalidInput
+	}
+
+	var (
+		action   = args[0]
+		fs       = flag.NewFlagSet("hosts "+action, flag.ExitOnError)
+		hostsYML = fs.String("knownhosts", defaultKnownHostsPath(), "known hosts")
+		id       = fs.String("id", "", "printer ID (add), defaults to the ID the printer reports")
+		alias    = fs.String("alias", "", "printer alias (add)")
+		timeout  = fs.Duration("timeout", 2*time.Second, "probe timeout (add)")
+	)
+	fs.BoolVar(&JSONOutput, "json", false, "print JSON (list)")
+	logFlags(fs)
+	fs.Usage = func() { fmt.Fprintf(os.Stderr, hostsUsage+"\nOptions:\n", os.Args[0]); fs.PrintDefaults() }
+	// the options may follow the arguments, e.g. "hosts add 192.168.1.5 -alias foo"
+	var pos []string
+	for rest := args[1:]; ; {
+		fs.Parse(rest)
+		if fs.NArg() == 0 {
+			break
+		}
+		if i := len(rest) - fs.NArg() - 1; i >= 0 && rest[i] == "--" {
+			pos = append(pos, fs.Args()...)
+			break
+		}
+		pos, rest = append(pos, fs.Arg(0)), fs.Args()[1:]
+	}
+	arg := func(i int) string {
+		if i < len(pos) {
+			return pos[i]
+		}
+		return ""
+	}
+
+	if err := loadConfig(fs, defaultConfigPath(), false); err != nil {
+		return fail(fmt.Errorf("%w: %w", errInvalidInput, err))
+	}
+	if err := setupLogging(); err != nil {
+		return fail(err)
+	}
+
+	ls, err := NewLocalStorage(*hostsYML)
+	if err != nil {
+		return fail(err)
+	}
+	switch action {
+	case "list":
+		return hostsList(ls, JSONOutput)
+	case "add":
+		err = hostsAdd(ls, arg(0), *id, *alias, *timeout)
+	case "remove":
+		err = hostsRemove(ls, pos)
+	case "rename":
+		if len(pos) != 2 {
+			fs.Usage()
+			return exitInvalidInput
+		}
+		err = hostsSet(ls, arg(0), []string{"alias=" + arg(1)})
+	case "set":
+		if len(pos) < 2 {
+			fs.Usage()
+			return exitInvalidInput
+		}
+		err = hostsSet(ls, arg(0), pos[1:])
+	case "rotate-token":
+		if len(pos) != 1 {
+			fs.Usage()
+			return exitInvalidInput
+		}
+		err = hostsRotateToken(ls, arg(0))
+	case "encrypt":
+		err = hostsEncrypt(ls, *hostsYML)
+	default:
+		fs.Usage()
+		return exitInvalidInput
+	}
+	if err == nil {
+		err = ls.Save()
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return exitOK
+}
+
+func hostsList(ls *LocalStorage, asJSON bool) int {
+	printers := ls.List()
+	if asJSON {
+		type host struct {
+			ID       string `json:"id"`
+			Alias    string `json:"alias,omitempty"`
+			IP       string `json:"ip"`
+			Model    string `json:"model"`
+			Protocol string `json:"protocol"`
+			Token    bool   `json:"token"`
+		}
+		hosts := []host{}
+		for _, p := range printers {
+			hosts = append(hosts, host{p.ID, p.Alias, p.IP, p.Model, p.Protocol(), p.Token != ""})
+		}
+		printJSON(hosts)
+		return exitOK
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tALIAS\tIP\tMODEL\tPROTOCOL\tTOKEN")
+	for _, p := range printers {
+		token := "-"
+		if p.Token != "" {
+			token = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", p.ID, p.Alias, p.IP, p.Model, p.Protocol(), token)
+	}
+	w.Flush()
+	return exitOK
+}
+
+// hostsAdd probes ip to find the ID, model and protocol of the printer.
+func hostsAdd(ls *LocalStorage, ip, id, alias string, timeout time.Duration) error {
+	ip = normalizeHost(ip)
+	if ip == "" {
+		return invalidInput("usage: hosts add [-id ID] [-alias ALIAS] <ip>")
+	}
+	p := scanHost(ip, timeout)
+	if p == nil {
+		return fmt.Errorf("%w: no printer answers at %s", errPrinterNotFound, ip)
+	}
+	if id != "" {
+		p.ID = id
+	}
+	if ls.Get(p.ID) != nil {
+		return fmt.Errorf("printer '%s' already exists", p.ID)
+	}
+	p.Alias = alias
+	ls.Add(p)
+	slog.Info("Added", "printer", p.String(), "protocol", p.Protocol())
+	return nil
+}
+
+func hostsRemove(ls *LocalStorage, hosts []string) error {
+	if len(hosts) == 0 {
+		return invalidInput("usage: hosts remove <host> ...")
+	}
+	for _, host := range hosts {
+		p := ls.Find(host)
+		if p == nil {
+			return fmt.Errorf("%w: '%s'", errPrinterNotFound, host)
+		}
+		ls.Remove(p)
+		slog.Info("Removed", "printer", p.String())
+	}
+	return nil
+}
+
+func hostsSet(ls *LocalStorage, host string, pairs []string) error {
+	p := ls.Find(host)
+	if p == nil {
+		return fmt.Errorf("%w: '%s'", errPrinterNotFound, host)
+	}
+
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("'%s' is not key=value", pair)
+		}
+		switch key {
+		case "alias":
+			for _, other := range ls.List() {
+				if value != "" && other != p && (strings.EqualFold(other.ID, value) || strings.EqualFold(other.Alias, value)) {
+					return fmt.Errorf("'%s' already names printer '%s'", value, other.ID)
+				}
+			}
+			p.Alias = value
+		case "id":
+			if err := ls.Rename(p, value); err != nil {
+				return err
+			}
+		case "ip":
+			p.IP = normalizeHost(value)
+		case "model":
+			p.Model = value
+		case "token":
+			p.Token = value
+		case "protocol":
+			switch strings.ToLower(value) {
+			case "sacp":
+				p.Sacp, p.Moonraker = true, false
+			case "http":
+				p.Sacp, p.Moonraker = false, false
+			case "moonraker":
+				p.Sacp, p.Moonraker = false, true
+			default:
+				return fmt.Errorf("unknown protocol '%s', use sacp, http or moonraker", value)
+			}
+		case "sacp", "moonraker":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			if key == "sacp" {
+				p.Sacp = b
+			} else {
+				p.Moonraker = b
+			}
+		default:
+			return fmt.Errorf("unknown key '%s'", key)
+		}
+	}
+	ls.Reindex()
+	slog.Info("Updated", "printer", p.String(), "protocol", p.Protocol())
+	return nil
+}
+
+// hostsRotateToken drops the token of a Snapmaker 2 and asks for a new one,
+// which must be approved on the touchscreen.
+func hostsRotateToken(ls *LocalStorage, host string) error {
+	p := ls.Find(host)
+	if p == nil {
+		return fmt.Errorf("%w: '%s'", errPrinterNotFound, host)
+	}
+	if p.Sacp || p.Moonraker {
+		return fmt.Errorf("printer '%s' does not use a token (%s)", p.ID, p.Protocol())
+	}
+
+	hc := &HTTPConnector{printer: p}
+	if p.Token != "" {
+		if _, err := hc.request().Post(hc.URL("/disconnect")); err != nil {
+			return err
+		}
+		p.Token = ""
+	}
+	if err := hc.Connect(); err != nil {
+		return err
+	}
+	hc.Disconnect()
+	slog.Info("New token", "printer", p.String())
+	return nil
+}
+
+// hostsEncrypt creates the key file if $TOKEN_KEY is not set, the tokens
+// are encrypted when the known hosts are saved.
+func hostsEncrypt(ls *LocalStorage, hostsYML string) error {
+	source := "$TOKEN_KEY"
+	if os.Getenv("TOKEN_KEY") == "" {
+		source = tokenKeyPath(hostsYML)
+		if err := createTokenKey(source); err != nil {
+			return err
+		}
+	}
+	aead, err := loadTokenKey(hostsYML)
+	if err != nil {
+		return err
+	}
+	ls.tokens = newTokenCipher(aead)
+	slog.Info("Tokens are encrypted with the key in " + source)
+	return nil
+}
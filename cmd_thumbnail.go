@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// thumbnailResult is the output of the thumbnail subcommand for a file.
+type thumbnailResult struct {
+	File   string `json:"file"`
+	PNG    string `json:"png"`
+	Source string `json:"source"` // embedded or rendered
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+/*
+runThumbnail implements "sm2uploader thumbnail [-o file.png] <files>", it
+saves the thumbnail the slicer embedded in the G-code as PNG, or renders a
+preview of the toolpath if there is none. The preview has the size of the
+touchscreen of -model, or of the printer of -host.
+*/
+func runThumbnail(args []string) int {
+	var (
+		fs       = flag.NewFlagSet("thumbnail", flag.ExitOnError)
+		output   = fs.String("o", "", "output file (one input file), default: the input file with .png")
+		render   = fs.Bool("render", false, "render the toolpath even if the file has a thumbnail")
+		size     = fs.String("size", "", "size of the rendered preview, e.g. 300x300, default: the size of the touchscreen")
+		model    = fs.String("model", "", "printer model, e.g. A350, J1, Artisan, U1")
+		host     = fs.String("host", os.Getenv("HOST"), "take the model of this known printer (ID, IP or alias)")
+		hostsYML = fs.String("knownhosts", defaultKnownHostsPath(), "known hosts")
+	)
+	fs.BoolVar(&JSONOutput, "json", false, "print JSON")
+	fs.BoolVar(&Debug, "debug", parseBoolEnv("DEBUG", false), "debug mode, same as -log-level debug")
+	logFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s thumbnail [-o file.png] [-render] [-size WxH] [-model M | -host H] [-json] <files>\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := loadConfig(fs, defaultConfigPath(), false); err != nil {
+		return fail(fmt.Errorf("%w: %w", errInvalidInput, err))
+	}
+	if err := setupLogging(); err != nil {
+		return fail(err)
+	}
+	if fs.NArg() == 0 {
+		return fail(invalidInput("no input files"))
+	}
+	if *output != "" && fs.NArg() > 1 {
+		return fail(invalidInput("-o needs one input file"))
+	}
+	printerModel, err := modelOf(*model, *host, *hostsYML)
+	if err != nil {
+		return fail(err)
+	}
+	var width, height int
+	if *size != "" {
+		if n, _ := fmt.Sscanf(*size, "%dx%d", &width, &height); n != 2 || width <= 0 || height <= 0 {
+			return fail(invalidInput("-size %s, use WxH", *size))
+		}
+	}
+
+	results := []*thumbnailResult{}
+	for _, file := range fs.Args() {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fail(invalidInput("%s", err))
+		}
+
+		r := &thumbnailResult{File: file, PNG: *output, Source: "embedded"}
+		if r.PNG == "" {
+			r.PNG = strings.TrimSuffix(file, filepath.Ext(file)) + ".png"
+		}
+		var img []byte
+		if !*render {
+			img = bestThumbnail(extractThumbnails(data))
+		}
+		if img == nil {
+			r.Source = "rendered"
+			w, h := width, height
+			if w == 0 {
+				m := machineModel(printerModel)
+				if m == "" {
+					if s, err := analyzeGcode(bytes.NewReader(data), file, ""); err == nil {
+						m = machineModel(s.Model) // from the slicer header
+					}
+				}
+				w, h = previewSize(m)
+			}
+			if img, err = renderPreview(data, file, printerModel, w, h); err != nil {
+				return fail(invalidInput("%s: %s", file, err))
+			}
+		}
+		if cfg, err := png.DecodeConfig(bytes.NewReader(img)); err == nil {
+			r.Width, r.Height = cfg.Width, cfg.Height
+		}
+		if err := os.WriteFile(r.PNG, img, 0644); err != nil {
+			return fail(err)
+		}
+		results = append(results, r)
+	}
+
+	if JSONOutput {
+		printJSON(results)
+		return exitOK
+	}
+	for _, r := range results {
+		fmt.Printf("%s: %s (%s, %dx%d)\n", r.File, r.PNG, r.Source, r.Width, r.Height)
+	}
+	return exitOK
+}
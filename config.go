@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Config is the content of config.yaml. The options are named like the flags,
+the smfix switches turn single stages of -fix on or off and the file
+extensions to fix have no flags:
+
+	host: J1V19
+	octoprint: :8844
+	timeout: 2s
+	sacp-timeout: 10s
+	debug: true
+	smfix:
+	  shutoff: false
+	extensions:
+	  .gcode: true
+
+A flag wins over its environment variable, which wins over the config file.
+*/
+type Config struct {
+	Options    map[string]any  `yaml:",inline"`
+	SMFix      map[string]bool `yaml:"smfix"`      // stages of -fix, e.g. shutoff
+	Extensions map[string]bool `yaml:"extensions"` // extension: fix with SMFix
+}
+
+// configSource is where the value of an option came from.
+type configSource struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Source string `json:"source"` // flag, env NAME, config or default
+}
+
+// configSources of the last loadConfig, by key
+var configSources = map[string]*configSource{}
+
+// environment variables that are not named like their flag
+var flagEnvNames = map[string]string{
+	"knownhosts": "KNOWN_HOSTS",
+	"apikeys":    "API_KEYS",
+	"apikey":     "API_KEY",
+	"output":     "OUTPUT_DIR",
+}
+
+// options shown masked by "config show"
+var secretOptions = []string{"apikey", "prusalink-password"}
+
+// defaultConfigPath returns $CONFIG or config.yaml next to the known hosts.
+func defaultConfigPath() string {
+	if env := os.Getenv("CONFIG"); env != "" {
+		return env
+	}
+	return filepath.Join(filepath.Dir(defaultKnownHostsPath()), "config.yaml")
+}
+
+// flagEnvName returns the environment variable of a flag, e.g. TOOL1 for
+// -tool1 and MOONRAKER_LISTEN for -moonraker-listen.
+func flagEnvName(name string) string {
+	if env, ok := flagEnvNames[name]; ok {
+		return env
+	}
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// envInEffect tells if the environment variable of f set its default, an
+// unparsable value is ignored like parse*Env does.
+func envInEffect(f *flag.Flag) bool {
+	value, ok := os.LookupEnv(flagEnvName(f.Name))
+	if !ok {
+		return false
+	}
+	var err error
+	switch f.Value.(flag.Getter).Get().(type) {
+	case bool:
+		_, err = strconv.ParseBool(value)
+	case int:
+		_, err = strconv.Atoi(value)
+	case time.Duration:
+		_, err = time.ParseDuration(value)
+	case FixOptions:
+		_, err = parseFixOptions(value)
+	default:
+		ok = value != ""
+	}
+	return ok && err == nil
+}
+
+/*
+loadConfig sets the flags of set that are not given on the command line or
+by their environment variable to the values in the config file at path,
+and records the source of every option. A missing file is fine unless path
+is not the default. Unknown options are errors if strict, subcommands only
+use the options they have.
+*/
+func loadConfig(set *flag.FlagSet, path string, strict bool) error {
+	var cfg Config
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && path == defaultConfigPath() {
+		err = nil
+	} else if err != nil {
+		return err
+	} else if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return fmt.Errorf("config %s is malformed: %w", path, err)
+	}
+
+	explicit := map[string]bool{}
+	set.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var errs []error
+	set.VisitAll(func(f *flag.Flag) {
+		src := &configSource{Key: f.Name, Source: "default"}
+		value, inConfig := cfg.Options[f.Name]
+		switch {
+		case explicit[f.Name]:
+			src.Source = "flag"
+		case envInEffect(f):
+			src.Source = "env " + flagEnvName(f.Name)
+		case inConfig:
+			if err := set.Set(f.Name, configValue(value)); err != nil {
+				errs = append(errs, fmt.Errorf("config %s: %s: %w", path, f.Name, err))
+			}
+			src.Source = "config"
+		}
+		src.Value = f.Value.String()
+		configSources[f.Name] = src
+	})
+	if strict {
+		for key := range cfg.Options {
+			if set.Lookup(key) == nil {
+				errs = append(errs, fmt.Errorf("config %s: unknown option '%s'", path, key))
+			}
+		}
+	}
+
+	// the smfix switches change the stages of -fix, unless it is given by a
+	// flag or an environment variable
+	fixSource := "default"
+	if src, ok := configSources["fix"]; ok && set.Lookup("fix") != nil {
+		fixSource = src.Source
+	}
+	for _, s := range fixStages {
+		v := SmFixOptions.stage(s.name)
+		src := &configSource{Key: "smfix." + s.name, Source: fixSource}
+		if value, ok := cfg.SMFix[s.name]; ok && (fixSource == "default" || fixSource == "config") {
+			*v, src.Source = value, "config"
+		}
+		src.Value = strconv.FormatBool(*v)
+		configSources[src.Key] = src
+	}
+	if src, ok := configSources["fix"]; ok && set.Lookup("fix") != nil {
+		src.Value = SmFixOptions.String()
+	}
+	for name := range cfg.SMFix {
+		if SmFixOptions.stage(name) == nil && strict {
+			errs = append(errs, fmt.Errorf("config %s: unknown smfix switch '%s', use %s", path, name, fixStageNames()))
+		}
+	}
+
+	for ext, fix := range cfg.Extensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		SmFixExtensions[ext] = fix
+		configSources["extensions"+ext] = &configSource{Key: "extensions" + ext, Source: "config"}
+	}
+	for ext, fix := range SmFixExtensions {
+		src, ok := configSources["extensions"+ext]
+		if !ok {
+			src = &configSource{Key: "extensions" + ext, Source: "default"}
+			configSources[src.Key] = src
+		}
+		src.Value = strconv.FormatBool(fix)
+	}
+
+	return errors.Join(errs...)
+}
+
+// configValue returns a yaml value as a flag value, lists are comma separated.
+func configValue(v any) string {
+	if list, ok := v.([]any); ok {
+		s := make([]string, len(list))
+		for i, e := range list {
+			s[i] = fmt.Sprint(e)
+		}
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprint(v)
+}
+
+// runConfig implements "sm2uploader config show [options]", the options
+// are the ones of the upload and server modes.
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "show" {
+		fmt.Fprintf(os.Stderr, "Usage: %s config show [-json] [options]\n", os.Args[0])
+		return exitInvalidInput
+	}
+
+	defineFlags()
+	flag.Usage = flag_usage
+	flag.CommandLine.Parse(args[1:])
+	if err := loadConfig(flag.CommandLine, ConfigFile, true); err != nil {
+		return fail(fmt.Errorf("%w: %w", errInvalidInput, err))
+	}
+
+	var sources []*configSource
+	for _, src := range configSources {
+		if slices.Contains(secretOptions, src.Key) && src.Value != "" {
+			src.Value = "***"
+		}
+		sources = append(sources, src)
+	}
+	slices.SortFunc(sources, func(a, b *configSource) int { return strings.Compare(a.Key, b.Key) })
+
+	if JSONOutput {
+		printJSON(sources)
+		return exitOK
+	}
+
+	fmt.Printf("# %s\n", ConfigFile)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+	for _, src := range sources {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", src.Key, src.Value, src.Source)
+	}
+	w.Flush()
+	return exitOK
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -14,15 +17,42 @@ const (
 )
 
 var (
-	errFileEmpty    = errors.New("File is empty.")
-	errFileTooLarge = errors.New("File is too large.")
+	errFileEmpty     = errors.New("File is empty.")
+	errFileTooLarge  = errors.New("File is too large.")
+	errConnectorBusy = errors.New("Printer is busy.")
+
+	// errStatusNotSupported is returned by the handlers that can not query
+	// the printer state
+	errStatusNotSupported = errors.New("status is not supported by this protocol")
+
+	// the commands map these to exit codes
+	errPrinterNotFound = errors.New("printer not found")
+	errAuthDenied      = errors.New("access denied")
+	errFixFailed       = errors.New("G-code fix failed")
 )
 
 type Payload struct {
+	ID        int64 // identifies the upload in progress events
 	File      io.Reader
 	Name      string
 	Size      int64
-	FixedFile string // path to the fixed (processed) file for streaming upload
+	FixedFile string     // path to the fixed (processed) file for streaming upload
+	Print     bool       // start printing once the upload has finished
+	Fix       FixOptions // SMFix stages, set by the caller
+
+	printer     *Printer    // upload target, set by Connector.Upload
+	fixErr      error       // why the G-code fix failed, the upload fails with it
+	analysis    *gcodeStats // of the G-code, set by preflight or the bridge
+	sizeUnknown bool        // Size is 0 until File reaches EOF, File checks the limits
+	requestID   string      // of the HTTP request that sent the file, for the log
+}
+
+// log returns l with the ID of the request that sent the file.
+func (p *Payload) log(l *slog.Logger) *slog.Logger {
+	if p.requestID == "" {
+		return l
+	}
+	return l.With("request", p.requestID)
 }
 
 func (p *Payload) SetName(name string) {
@@ -33,11 +63,15 @@ func (p *Payload) ReadableSize() string {
 	return humanReadableSize(p.Size)
 }
 
-func (p *Payload) GetContent(nofix bool) (cont []byte, err error) {
-	if nofix || !p.ShouldBeFix() {
+func (p *Payload) GetContent() (cont []byte, err error) {
+	if p.Fix.NoFix || !p.ShouldBeFix() {
 		cont, err = io.ReadAll(p.File)
 	} else {
-		cont, err = postProcess(p.File)
+		p.publish(PhaseFixing, 0, p.Size)
+		if cont, err = postProcess(p.File, p.printerModel(), p.Fix, p.log(logSMFix)); err != nil {
+			p.fixErr = err
+			return nil, fmt.Errorf("%w: %w", errFixFailed, err)
+		}
 		p.Size = int64(len(cont))
 	}
 	return cont, err
@@ -48,8 +82,8 @@ func (p *Payload) GetContent(nofix bool) (cont []byte, err error) {
 // For files that need G-Code fixing and have a FixedFile on disk, it opens the
 // fixed file for streaming to release memory pressure.
 // Otherwise, it pipes through postProcess.
-func (p *Payload) StreamContent(nofix bool) (io.ReadCloser, error) {
-	if nofix || !p.ShouldBeFix() {
+func (p *Payload) StreamContent() (io.ReadCloser, error) {
+	if p.Fix.NoFix || !p.ShouldBeFix() {
 		// Try to use ReadCloser directly if the underlying reader supports it
 		if rc, ok := p.File.(io.ReadCloser); ok {
 			return rc, nil
@@ -72,9 +106,11 @@ func (p *Payload) StreamContent(nofix bool) (io.ReadCloser, error) {
 	// For files that need post-processing, use a pipe to stream
 	pr, pw := io.Pipe()
 	go func() {
-		cont, err := postProcess(p.File)
+		p.publish(PhaseFixing, 0, p.Size)
+		cont, err := postProcess(p.File, p.printerModel(), p.Fix, p.log(logSMFix))
 		if err != nil {
-			pw.CloseWithError(err)
+			p.fixErr = err
+			pw.CloseWithError(fmt.Errorf("%w: %w", errFixFailed, err))
 			return
 		}
 		p.Size = int64(len(cont))
@@ -84,20 +120,95 @@ func (p *Payload) StreamContent(nofix bool) (io.ReadCloser, error) {
 	return pr, nil
 }
 
+// printerModel returns the model of the upload target, "" if unknown.
+func (p *Payload) printerModel() string {
+	if p.printer == nil {
+		return ""
+	}
+	return p.printer.Model
+}
+
+// publish sends a progress event for this payload.
+func (p *Payload) publish(phase ProgressPhase, sent, total int64) {
+	p.publishChunk(phase, sent, total, 0, 0)
+}
+
+func (p *Payload) publishChunk(phase ProgressPhase, sent, total int64, chunk, chunks int) {
+	e := ProgressEvent{
+		Upload: p.ID,
+		File:   p.Name,
+		Phase:  phase,
+		Sent:   sent,
+		Total:  total,
+		Chunk:  chunk,
+		Chunks: chunks,
+	}
+	if p.printer != nil {
+		e.Printer = printerKey(p.printer)
+		e.Protocol = p.printer.Protocol()
+	}
+	Progress.Publish(e)
+}
+
+func (p *Payload) publishError(err error) {
+	e := ProgressEvent{
+		Upload: p.ID,
+		File:   p.Name,
+		Phase:  PhaseFailed,
+		Total:  p.Size,
+		Error:  err.Error(),
+	}
+	if p.printer != nil {
+		e.Printer = printerKey(p.printer)
+		e.Protocol = p.printer.Protocol()
+	}
+	Progress.Publish(e)
+}
+
+// checkSize returns an error if the file is empty or too large, nil while the
+// size is unknown.
+func (p *Payload) checkSize() error {
+	switch {
+	case p.sizeUnknown:
+	case p.Size > FILE_SIZE_MAX:
+		return errFileTooLarge
+	case p.Size < FILE_SIZE_MIN:
+		return errFileEmpty
+	}
+	return nil
+}
+
 func (p *Payload) ShouldBeFix() bool {
 	return shouldBeFix(p.Name)
 }
 
 func NewPayload(file io.Reader, name string, size int64) *Payload {
 	return &Payload{
+		ID:   uploadSeq.Add(1),
 		File: file,
 		Name: normalizedFilename(name),
 		Size: size,
 	}
 }
 
+// PrinterStatus is a snapshot of the printer state reported by a handler.
+// Fields that a protocol can not report are left empty.
+type PrinterStatus struct {
+	State    string         `json:"state"`
+	File     string         `json:"file,omitempty"`
+	Progress float64        `json:"progress"` // 0..1
+	Nozzles  []*Temperature `json:"nozzles,omitempty"`
+	Bed      *Temperature   `json:"bed,omitempty"`
+}
+
+type Temperature struct {
+	Actual float64 `json:"actual"`
+	Target float64 `json:"target"`
+}
+
 type connector struct {
 	handlers []Handler
+	mu       sync.Mutex // handlers keep per-connection state, one operation at a time
 }
 
 type Handler interface {
@@ -108,14 +219,20 @@ type Handler interface {
 	SetToolTemperature(int, int) error
 	SetBedTemperature(int, int) error
 	Home() error
+	Status() (*PrinterStatus, error)
+	StartPrint(string) error
+	PausePrint() error
+	ResumePrint() error
+	StopPrint() error
 }
 
 func (c *connector) RegisterHandler(h Handler) {
 	c.handlers = append(c.handlers, h)
 }
 
-// Upload to upload a file to a printer
-func (c *connector) Upload(printer *Printer, payload *Payload) error {
+// session finds the first handler that can reach the printer, connects and
+// runs fn with it. The caller must hold c.mu.
+func (c *connector) session(printer *Printer, fn func(Handler) error) error {
 	// Iterate through all handlers
 	for _, h := range c.handlers {
 		// Check if handler can ping the printer
@@ -126,66 +243,161 @@ func (c *connector) Upload(printer *Printer, payload *Payload) error {
 			}
 			defer h.Disconnect()
 
-			if payload.Size > FILE_SIZE_MAX {
-				return errFileTooLarge
-			}
-			if payload.Size < FILE_SIZE_MIN {
-				return errFileEmpty
-			}
-			// Upload the file to the printer
-			if err := h.Upload(payload); err != nil {
-				return err
-			}
-
-			// Return nil if successful
-			return nil
+			return fn(h)
 		}
 	}
 	// Return error if printer is not available
-	return errors.New("Printer " + printer.IP + " is not available.")
+	return fmt.Errorf("%w: %s does not answer", errPrinterNotFound, printer.IP)
+}
+
+// do runs fn in a new session, waiting for any running operation to finish.
+func (c *connector) do(printer *Printer, fn func(Handler) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session(printer, fn)
+}
+
+// Upload to upload a file to a printer
+func (c *connector) Upload(printer *Printer, payload *Payload) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	payload.printer = printer
+	defer func() {
+		if err != nil {
+			payload.publishError(err)
+		} else {
+			payload.publish(PhaseDone, payload.Size, payload.Size)
+		}
+	}()
+
+	payload.publish(PhaseConnecting, 0, payload.Size)
+	err = c.session(printer, func(h Handler) error {
+		if err := payload.checkSize(); err != nil {
+			return err
+		}
+		// Upload the file to the printer
+		return h.Upload(payload)
+	})
+	// the protocols may lose the read error of a file of unknown size
+	if err == nil {
+		err = payload.checkSize()
+	}
+	// the protocols may lose the error of the fix while streaming
+	if err != nil && payload.fixErr != nil && !errors.Is(err, errFixFailed) {
+		err = fmt.Errorf("%w: %w", errFixFailed, payload.fixErr)
+	}
+	if err != nil || !payload.Print {
+		return err
+	}
+
+	// Some protocols close the session when the transfer is finished,
+	// start the print with a new one.
+	err = c.session(printer, func(h Handler) error {
+		return h.StartPrint(payload.Name)
+	})
+	return err
+}
+
+// dryRun does what Upload does without connecting to the printer: the
+// payload is fixed and read to the end.
+func dryRun(printer *Printer, payload *Payload) (err error) {
+	payload.printer = printer
+	defer func() {
+		if err != nil {
+			payload.publishError(err)
+		} else {
+			payload.publish(PhaseDone, payload.Size, payload.Size)
+		}
+	}()
+
+	rc, err := payload.StreamContent()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	n, err := io.Copy(io.Discard, rc)
+	if err != nil {
+		if payload.fixErr != nil && !errors.Is(err, errFixFailed) {
+			err = fmt.Errorf("%w: %w", errFixFailed, payload.fixErr)
+		}
+		return err
+	}
+	payload.Size = n
+	if !payload.Fix.NoFix && payload.ShouldBeFix() {
+		payload.log(logSMFix).Info("G-Code fixed", "file", payload.Name)
+	}
+	payload.log(slog.Default()).Info("Dry run, not uploaded", "file", payload.Name, "size", payload.ReadableSize(), "printer", printerKey(printer), "protocol", printer.Protocol(), "print", payload.Print)
+	return nil
 }
 
 func (c *connector) PreHeatCommands(printer *Printer, tool_1_temperature int, tool_2_temperature int, bed_temperature int, home bool) error {
-	// Iterate through all handlers
-	for _, h := range c.handlers {
-		// Check if handler can ping the printer
-		if h.Ping(printer) {
-			// Connect to the printer
-			if err := h.Connect(); err != nil {
+	return c.do(printer, func(h Handler) error {
+		// Send the GCode command to the printer
+		if tool_1_temperature > 0 {
+			if err := h.SetToolTemperature(0, tool_1_temperature); err != nil {
 				return err
 			}
-			defer h.Disconnect()
-
-			// Send the GCode command to the printer
-			if tool_1_temperature > 0 {
-				if err := h.SetToolTemperature(0, tool_1_temperature); err != nil {
-					return err
-				}
+		}
+		if tool_2_temperature > 0 {
+			if err := h.SetToolTemperature(1, tool_2_temperature); err != nil {
+				return err
 			}
-			if tool_2_temperature > 0 {
-				if err := h.SetToolTemperature(1, tool_2_temperature); err != nil {
-					return err
-				}
+		}
+		if bed_temperature > 0 {
+			if err := h.SetBedTemperature(0, bed_temperature); err != nil {
+				return err
 			}
-			if bed_temperature > 0 {
-				if err := h.SetBedTemperature(0, bed_temperature); err != nil {
-					return err
-				}
-				if err := h.SetBedTemperature(1, bed_temperature); err != nil {
-					return err
-				}
+			if err := h.SetBedTemperature(1, bed_temperature); err != nil {
+				return err
 			}
-			if home {
-				if err := h.Home(); err != nil {
-					return err
-				}
+		}
+		if home {
+			if err := h.Home(); err != nil {
+				return err
 			}
-			// Return nil if successful
-			return nil
 		}
+		return nil
+	})
+}
+
+// Status queries the printer state. It does not wait for a running upload,
+// errConnectorBusy is returned instead.
+func (c *connector) Status(printer *Printer) (status *PrinterStatus, err error) {
+	if !c.mu.TryLock() {
+		return nil, errConnectorBusy
 	}
-	// Return error if printer is not available
-	return errors.New("Printer " + printer.IP + " is not available.")
+	defer c.mu.Unlock()
+
+	err = c.session(printer, func(h Handler) (err error) {
+		status, err = h.Status()
+		return
+	})
+	return
+}
+
+func (c *connector) StartPrint(printer *Printer, filename string) error {
+	return c.do(printer, func(h Handler) error {
+		return h.StartPrint(filename)
+	})
+}
+
+func (c *connector) PausePrint(printer *Printer) error {
+	return c.do(printer, func(h Handler) error {
+		return h.PausePrint()
+	})
+}
+
+func (c *connector) ResumePrint(printer *Printer) error {
+	return c.do(printer, func(h Handler) error {
+		return h.ResumePrint()
+	})
+}
+
+func (c *connector) StopPrint(printer *Printer) error {
+	return c.do(printer, func(h Handler) error {
+		return h.StopPrint()
+	})
 }
 
 var Connector = &connector{}
@@ -3,18 +3,14 @@ package main
 import (
 	"fmt"
 	"io"
-	"log"
-	"os"
 	"time"
 
-	"github.com/gosuri/uilive"
 	"github.com/imroc/req/v3"
 )
 
-const (
-	HTTPPort    = "8080"
-	HTTPTimeout = 5
-)
+const HTTPPort = "8080"
+
+var HTTPTimeout = 5 * time.Second
 
 const (
 	AuthStatusApproved = 1 + iota
@@ -48,9 +44,7 @@ func (hc *HTTPConnector) Connect() error {
 		SetRetryCount(3).
 		SetRetryFixedInterval(1 * time.Second).
 		SetRetryCondition(func(r *req.Response, err error) bool {
-			if Debug {
-				log.Printf("-- retrying %s -> %d, token %s", r.Request.URL, r.StatusCode, hc.printer.Token)
-			}
+			logHTTP.Debug("Retrying", "url", r.Request.URL.Path, "status", r.StatusCode)
 
 			// token expired
 			if r.StatusCode == 403 && hc.printer.Token != "" {
@@ -77,12 +71,13 @@ func (hc *HTTPConnector) Connect() error {
 			case AuthStatusWaiting:
 				if !tip {
 					tip = true
-					log.Println(">>> Please tap Yes on Snapmaker touchscreen to continue <<<")
+					logHTTP.Info(">>> Please tap Yes on Snapmaker touchscreen to continue <<<", "printer", printerKey(hc.printer))
+					publishPrinter(hc.printer, PhaseAuthorizing)
 				}
 				// wait for auth on HMI
 				<-time.After(2 * time.Second)
 			case AuthStatusDenied:
-				return fmt.Errorf("access denied")
+				return errAuthDenied
 			}
 		}
 		/*
@@ -105,25 +100,86 @@ func (hc *HTTPConnector) Disconnect() (err error) {
 }
 
 func (hc *HTTPConnector) SetToolTemperature(tool int, temperature int) (err error) {
-	// *** NOT IMPLEMENTED ***
-	err = fmt.Errorf("not implemented")
-	return
+	return hc.executeCode(fmt.Sprintf("M104 T%d S%d", tool, temperature))
 }
 
 func (hc *HTTPConnector) SetBedTemperature(tool int, temperature int) (err error) {
-	// *** NOT IMPLEMENTED ***
-	err = fmt.Errorf("not implemented")
-	return
+	// Snapmaker 2 has a single heated bed zone
+	if tool > 0 {
+		return nil
+	}
+	return hc.executeCode(fmt.Sprintf("M140 S%d", temperature))
 }
 
 func (hc *HTTPConnector) Home() (err error) {
-	// *** NOT IMPLEMENTED ***
-	err = fmt.Errorf("not implemented")
-	return
+	return hc.executeCode("G28")
+}
+
+func (hc *HTTPConnector) Status() (*PrinterStatus, error) {
+	result := struct {
+		Status                     string  `json:"status"`
+		FileName                   string  `json:"fileName"`
+		Progress                   float64 `json:"progress"`
+		NozzleTemperature          float64 `json:"nozzleTemperature"`
+		NozzleTargetTemperature    float64 `json:"nozzleTargetTemperature"`
+		HeatedBedTemperature       float64 `json:"heatedBedTemperature"`
+		HeatedBedTargetTemperature float64 `json:"heatedBedTargetTemperature"`
+	}{}
+	resp, err := hc.request().SetResult(&result).Get(hc.URL("/status"))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("status error %d", resp.StatusCode)
+	}
+	return &PrinterStatus{
+		State:    result.Status,
+		File:     result.FileName,
+		Progress: result.Progress,
+		Nozzles:  []*Temperature{{Actual: result.NozzleTemperature, Target: result.NozzleTargetTemperature}},
+		Bed:      &Temperature{Actual: result.HeatedBedTemperature, Target: result.HeatedBedTargetTemperature},
+	}, nil
+}
+
+// StartPrint starts the file loaded by /prepare_print, Snapmaker 2 can not
+// start a print by name, see Upload.
+func (hc *HTTPConnector) StartPrint(filename string) error {
+	return hc.post("/start_print", nil)
+}
+
+func (hc *HTTPConnector) PausePrint() error {
+	return hc.post("/pause_print", nil)
+}
+
+func (hc *HTTPConnector) ResumePrint() error {
+	return hc.post("/resume_print", nil)
+}
+
+func (hc *HTTPConnector) StopPrint() error {
+	return hc.post("/stop_print", nil)
+}
+
+func (hc *HTTPConnector) executeCode(code string) error {
+	return hc.post("/execute_code", map[string]string{"code": code})
+}
+
+func (hc *HTTPConnector) post(path string, form map[string]string) error {
+	r := hc.request()
+	if form != nil {
+		r.SetFormData(form)
+	}
+	resp, err := r.Post(hc.URL(path))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s error %d", path, resp.StatusCode)
+	}
+	return nil
 }
 
 func (hc *HTTPConnector) Upload(payload *Payload) (err error) {
-	log.Printf("Uploading via HTTP protocol")
+	payload.log(logHTTP).Info("Uploading via HTTP protocol", "file", payload.Name)
 	finished := make(chan empty, 1)
 	defer func() {
 		finished <- empty{}
@@ -135,58 +191,53 @@ func (hc *HTTPConnector) Upload(payload *Payload) (err error) {
 			case <-ticker.C:
 				hc.checkStatus()
 			case <-finished:
-				if Debug {
-					log.Printf("-- heartbeat stopped")
-				}
+				logHTTP.Debug("Heartbeat stopped")
 				ticker.Stop()
 				return
 			}
 		}
 	}()
 
-	w := uilive.New()
-	w.Start()
-	log.SetOutput(w)
-	defer func() {
-		w.Stop()
-		log.SetOutput(os.Stderr)
-	}()
-
 	file := req.FileUpload{
 		ParamName: "file",
 		FileName:  payload.Name,
 		GetFileContent: func() (io.ReadCloser, error) {
-			rc, err := payload.StreamContent(NoFix)
-			if !NoFix && err == nil && payload.ShouldBeFix() {
-				log.SetOutput(os.Stderr)
-				log.Printf("G-Code fixed")
-				log.SetOutput(w)
+			rc, err := payload.StreamContent()
+			if !payload.Fix.NoFix && err == nil && payload.ShouldBeFix() {
+				payload.log(logSMFix).Info("G-Code fixed", "file", payload.Name)
 			} else if err != nil {
-				log.SetOutput(os.Stderr)
-				log.Printf("G-Code fix error(ignored): %s", err)
-				log.SetOutput(w)
+				payload.log(logSMFix).Warn("G-Code fix error (ignored)", "file", payload.Name, "err", err)
 			}
 			return rc, err
 		},
-		FileSize: payload.Size,
+		FileSize: payload.Size, // 0 if unknown, the callback takes it from the payload
 		// ContentType: "application/octet-stream",
 	}
+	verifying := false
 	r := hc.request(0)
 	r.SetFileUpload(file)
 	r.SetUploadCallbackWithInterval(func(info req.UploadInfo) {
-		if info.FileSize > 0 {
-			perc := float64(info.UploadedSize) / float64(info.FileSize) * 100.0
-			log.Printf("  - HTTP sending %.1f%%", perc)
-		} else {
-			log.Printf("  - HTTP sending %s...", humanReadableSize(info.UploadedSize))
+		total := info.FileSize
+		if total == 0 {
+			total = payload.Size // a streamed file, set when it was read to the end
+		}
+		payload.publish(PhaseUploading, info.UploadedSize, total)
+		if !verifying && total > 0 && info.UploadedSize >= total {
+			verifying = true
+			payload.publish(PhaseVerifying, info.UploadedSize, total)
 		}
 	}, 35*time.Millisecond)
 
-	_, err = r.Post(hc.URL("/upload"))
+	// prepare_print uploads the file and loads it, so StartPrint can start it
+	path := "/upload"
+	if payload.Print {
+		path = "/prepare_print"
+	}
+	_, err = r.Post(hc.URL(path))
 	return
 }
 
-func (hc *HTTPConnector) request(timeout ...int) *req.Request {
+func (hc *HTTPConnector) request(timeout ...time.Duration) *req.Request {
 	to := HTTPTimeout
 	if len(timeout) > 0 {
 		to = timeout[0]
@@ -200,7 +251,7 @@ func (hc *HTTPConnector) request(timeout ...int) *req.Request {
 		}
 	}
 
-	req := hc.client.SetTimeout(time.Second * time.Duration(to)).R()
+	req := hc.client.SetTimeout(to).R()
 	// for GET
 	req.SetQueryParam("token", hc.printer.Token)
 	// for POST
@@ -211,9 +262,7 @@ func (hc *HTTPConnector) request(timeout ...int) *req.Request {
 
 func (hc *HTTPConnector) checkStatus() (status int) {
 	r, err := hc.request().Get(hc.URL("/status"))
-	if Debug {
-		log.Printf("-- heartbeat: %d, err(%s)", r.StatusCode, err)
-	}
+	logHTTP.Debug("Heartbeat", "status", r.StatusCode, "err", err)
 	if err == nil {
 		switch r.StatusCode {
 		case 200:
@@ -234,7 +283,7 @@ func (hc *HTTPConnector) checkStatus() (status int) {
 URL to make url with path
 */
 func (hc *HTTPConnector) URL(path string) string {
-	return fmt.Sprintf("http://%s:%s/api/v1%s", hc.printer.IP, HTTPPort, path)
+	return fmt.Sprintf("http://%s/api/v1%s", urlHost(hc.printer.IP, HTTPPort), path)
 }
 
 func init() {
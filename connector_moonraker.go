@@ -2,21 +2,19 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"mime/multipart"
 	"net/http"
-	"os"
+	"net/url"
+	"strings"
 	"time"
-
-	"github.com/gosuri/uilive"
 )
 
-const (
-	MoonrakerPort    = "80"
-	MoonrakerTimeout = 120 // large G-code files may take a while
-)
+const MoonrakerPort = "80"
+
+var MoonrakerTimeout = 120 * time.Second // large G-code files may take a while
 
 type MoonrakerConnector struct {
 	httpClient *http.Client
@@ -43,39 +41,128 @@ func (mc *MoonrakerConnector) Disconnect() error {
 }
 
 func (mc *MoonrakerConnector) SetToolTemperature(tool int, temperature int) error {
-	return fmt.Errorf("not implemented")
+	return mc.gcodeScript(fmt.Sprintf("M104 T%d S%d", tool, temperature))
 }
 
 func (mc *MoonrakerConnector) SetBedTemperature(tool int, temperature int) error {
-	return fmt.Errorf("not implemented")
+	if tool > 0 {
+		return nil
+	}
+	return mc.gcodeScript(fmt.Sprintf("M140 S%d", temperature))
 }
 
 func (mc *MoonrakerConnector) Home() error {
-	return fmt.Errorf("not implemented")
+	return mc.gcodeScript("G28")
 }
 
-func (mc *MoonrakerConnector) Upload(payload *Payload) error {
-	log.Printf("Uploading via Moonraker HTTP protocol")
+func (mc *MoonrakerConnector) Status() (*PrinterStatus, error) {
+	type heater struct {
+		Temperature float64 `json:"temperature"`
+		Target      float64 `json:"target"`
+	}
+	result := struct {
+		Result struct {
+			Status struct {
+				Extruder   *heater `json:"extruder"`
+				Extruder1  *heater `json:"extruder1"`
+				HeaterBed  *heater `json:"heater_bed"`
+				PrintStats struct {
+					State    string `json:"state"`
+					Filename string `json:"filename"`
+				} `json:"print_stats"`
+				DisplayStatus struct {
+					Progress float64 `json:"progress"`
+				} `json:"display_status"`
+			} `json:"status"`
+		} `json:"result"`
+	}{}
+
+	resp, err := mc.client().Get(mc.URL("/printer/objects/query?extruder&extruder1&heater_bed&print_stats&display_status"))
+	if err != nil {
+		return nil, fmt.Errorf("moonraker query failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("moonraker query returned HTTP %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("moonraker query failed: %w", err)
+	}
+
+	st := result.Result.Status
+	status := &PrinterStatus{
+		State:    strings.ToUpper(st.PrintStats.State),
+		File:     st.PrintStats.Filename,
+		Progress: st.DisplayStatus.Progress,
+	}
+	for _, h := range []*heater{st.Extruder, st.Extruder1} {
+		if h != nil {
+			status.Nozzles = append(status.Nozzles, &Temperature{Actual: h.Temperature, Target: h.Target})
+		}
+	}
+	if st.HeaterBed != nil {
+		status.Bed = &Temperature{Actual: st.HeaterBed.Temperature, Target: st.HeaterBed.Target}
+	}
+	return status, nil
+}
+
+func (mc *MoonrakerConnector) StartPrint(filename string) error {
+	return mc.post("/printer/print/start?filename=" + url.QueryEscape(filename))
+}
+
+func (mc *MoonrakerConnector) PausePrint() error {
+	return mc.post("/printer/print/pause")
+}
+
+func (mc *MoonrakerConnector) ResumePrint() error {
+	return mc.post("/printer/print/resume")
+}
 
-	w := uilive.New()
-	w.Start()
-	log.SetOutput(w)
-	defer func() {
-		w.Stop()
-		log.SetOutput(os.Stderr)
-	}()
+func (mc *MoonrakerConnector) StopPrint() error {
+	return mc.post("/printer/print/cancel")
+}
+
+func (mc *MoonrakerConnector) gcodeScript(script string) error {
+	return mc.post("/printer/gcode/script?script=" + url.QueryEscape(script))
+}
+
+func (mc *MoonrakerConnector) post(path string) error {
+	resp, err := mc.client().Post(mc.URL(path), "application/json", nil)
+	if err != nil {
+		return fmt.Errorf("moonraker %s failed: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 401 || resp.StatusCode == 403 {
+		return fmt.Errorf("moonraker %s: %w", path, errAuthDenied)
+	}
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("moonraker %s returned HTTP %d: %s", path, resp.StatusCode, string(body))
+	}
+	return nil
+}
 
-	rc, err := payload.StreamContent(NoFix)
+func (mc *MoonrakerConnector) client() *http.Client {
+	if mc.httpClient == nil {
+		mc.httpClient = &http.Client{
+			Timeout: MoonrakerTimeout,
+		}
+	}
+	return mc.httpClient
+}
+
+func (mc *MoonrakerConnector) Upload(payload *Payload) error {
+	payload.log(logMoonraker).Info("Uploading via Moonraker HTTP protocol", "file", payload.Name)
+
+	rc, err := payload.StreamContent()
 	if err != nil {
 		// G-Code fix failed, fallback to original file content
-		log.SetOutput(os.Stderr)
-		log.Printf("G-Code fix error(ignored): %s", err)
-		log.SetOutput(w)
+		payload.log(logSMFix).Warn("G-Code fix error (ignored)", "file", payload.Name, "err", err)
 		fileContent, readErr := io.ReadAll(payload.File)
 		if readErr != nil {
 			return fmt.Errorf("moonraker read content failed: %w", readErr)
 		}
-		return uploadMoonraker(mc, payload.Name, fileContent)
+		return uploadMoonraker(mc, payload, fileContent)
 	}
 	defer rc.Close()
 
@@ -84,23 +171,21 @@ func (mc *MoonrakerConnector) Upload(payload *Payload) error {
 		return fmt.Errorf("moonraker read content failed: %w", err)
 	}
 
-	if !NoFix && payload.ShouldBeFix() {
-		log.SetOutput(os.Stderr)
-		log.Printf("G-Code fixed")
-		log.SetOutput(w)
+	if !payload.Fix.NoFix && payload.ShouldBeFix() {
+		payload.log(logSMFix).Info("G-Code fixed", "file", payload.Name)
 	}
 
-	return uploadMoonraker(mc, payload.Name, fileContent)
+	return uploadMoonraker(mc, payload, fileContent)
 }
 
 // uploadMoonraker builds the full multipart/form-data body in memory so
 // Content-Length is set, avoiding chunked transfer encoding which causes
 // 502 from nginx. A progressReader provides real-time upload progress.
-func uploadMoonraker(mc *MoonrakerConnector, filename string, fileContent []byte) error {
+func uploadMoonraker(mc *MoonrakerConnector, payload *Payload, fileContent []byte) error {
 	var buf bytes.Buffer
 	mw := multipart.NewWriter(&buf)
 	mw.WriteField("root", "gcodes")
-	fw, err := mw.CreateFormFile("file", filename)
+	fw, err := mw.CreateFormFile("file", payload.Name)
 	if err != nil {
 		return fmt.Errorf("moonraker create form file failed: %w", err)
 	}
@@ -116,12 +201,11 @@ func uploadMoonraker(mc *MoonrakerConnector, filename string, fileContent []byte
 		total:      totalSize,
 		lastUpdate: time.Now(),
 		onProgress: func(uploaded int64) {
-			if totalSize > 0 {
-				perc := float64(uploaded) / float64(totalSize) * 100.0
-				log.Printf("  - Moonraker sending %.1f%%", perc)
-			} else {
-				log.Printf("  - Moonraker sending %s...", humanReadableSize(uploaded))
-			}
+			payload.publish(PhaseUploading, uploaded, totalSize)
+		},
+		onDone: func() {
+			payload.publish(PhaseUploading, totalSize, totalSize)
+			payload.publish(PhaseVerifying, totalSize, totalSize)
 		},
 	}
 
@@ -132,20 +216,15 @@ func uploadMoonraker(mc *MoonrakerConnector, filename string, fileContent []byte
 	req.Header.Set("Content-Type", mw.FormDataContentType())
 	req.ContentLength = totalSize
 
-	client := mc.httpClient
-	if client == nil {
-		client = &http.Client{
-			Timeout: time.Second * time.Duration(MoonrakerTimeout),
-		}
-		mc.httpClient = client
-	}
-
-	resp, err := client.Do(req)
+	resp, err := mc.client().Do(req)
 	if err != nil {
 		return fmt.Errorf("moonraker upload failed: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == 401 || resp.StatusCode == 403 {
+		return fmt.Errorf("moonraker upload: %w", errAuthDenied)
+	}
 	if resp.StatusCode != 201 {
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("moonraker upload returned HTTP %d: %s", resp.StatusCode, string(body))
@@ -154,16 +233,18 @@ func uploadMoonraker(mc *MoonrakerConnector, filename string, fileContent []byte
 }
 
 func (mc *MoonrakerConnector) URL(path string) string {
-	return fmt.Sprintf("http://%s:%s%s", mc.printer.IP, MoonrakerPort, path)
+	return fmt.Sprintf("http://%s%s", urlHost(mc.printer.IP, MoonrakerPort), path)
 }
 
 // progressReader wraps an io.Reader and reports progress at intervals.
+// onDone is optional and called once the reader is drained.
 type progressReader struct {
 	reader     io.Reader
 	total      int64
 	uploaded   int64
 	lastUpdate time.Time
 	onProgress func(int64)
+	onDone     func()
 }
 
 func (pr *progressReader) Read(p []byte) (int, error) {
@@ -173,6 +254,10 @@ func (pr *progressReader) Read(p []byte) (int, error) {
 		pr.lastUpdate = time.Now()
 		pr.onProgress(pr.uploaded)
 	}
+	if err == io.EOF && pr.onDone != nil {
+		pr.onDone()
+		pr.onDone = nil
+	}
 	return n, err
 }
 
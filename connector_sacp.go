@@ -1,22 +1,29 @@
 package main
 
 import (
-	"log"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"net"
-	"os"
 	"time"
-
-	"github.com/gosuri/uilive"
 )
 
+var SACPTimeout = 5 * time.Second
+
 const (
-	SACPPort    = "8888"
-	SACPTimeout = 5
+	SACPPort = "8888"
+
+	SACPHeadPrinting = 0 // head type for 3D printing, used by SACP_start_screen_print
 )
 
 type SACPConnector struct {
 	printer *Printer
 	conn    net.Conn
+
+	// name and md5 of the last uploaded file, the printer needs both to start a print
+	lastName string
+	lastMD5  string
 }
 
 func (sc *SACPConnector) Ping(p *Printer) bool {
@@ -32,7 +39,7 @@ func (sc *SACPConnector) Ping(p *Printer) bool {
 }
 
 func (sc *SACPConnector) Connect() (err error) {
-	conn, err := SACP_connect(sc.printer.IP, SACPTimeout*time.Second)
+	conn, err := SACP_connect(sc.printer.IP, SACPTimeout)
 	if conn != nil {
 		sc.conn = conn
 	}
@@ -41,20 +48,20 @@ func (sc *SACPConnector) Connect() (err error) {
 
 func (sc *SACPConnector) Disconnect() error {
 	if sc.conn != nil {
-		SACP_disconnect(sc.conn, SACPTimeout*time.Second)
+		SACP_disconnect(sc.conn, SACPTimeout)
 		sc.conn.Close()
 	}
 	return nil
 }
 
 func (sc *SACPConnector) Upload(payload *Payload) (err error) {
-	log.Printf("Uploading via SACP protocol")
+	payload.log(logSACP).Info("Uploading via SACP protocol", "file", payload.Name)
 
-	rc, err := payload.StreamContent(NoFix)
-	if !NoFix && err == nil && payload.ShouldBeFix() {
-		log.Printf("G-Code fixed")
+	rc, err := payload.StreamContent()
+	if !payload.Fix.NoFix && err == nil && payload.ShouldBeFix() {
+		payload.log(logSMFix).Info("G-Code fixed", "file", payload.Name)
 	} else if err != nil {
-		log.Printf("G-Code fix error(ignored): %s", err)
+		payload.log(logSMFix).Warn("G-Code fix error (ignored)", "file", payload.Name, "err", err)
 	}
 	if err != nil {
 		// If StreamContent returned an error but we can fall back to raw file
@@ -64,33 +71,62 @@ func (sc *SACPConnector) Upload(payload *Payload) (err error) {
 	}
 	defer rc.Close()
 
-	w := uilive.New()
-	w.Start()
-	log.SetOutput(w)
-	defer func() {
-		w.Stop()
-		log.SetOutput(os.Stderr)
-	}()
-
-	err = SACP_start_upload_reader(sc.conn, payload.Name, rc, payload.Size, SACPTimeout*time.Second)
+	h := md5.New()
+	onProgress := func(sent, total int64, chunk, chunks int) {
+		payload.publishChunk(PhaseUploading, sent, total, chunk, chunks)
+		if chunk == chunks {
+			// the printer checks the md5 before it confirms the upload
+			payload.publishChunk(PhaseVerifying, sent, total, chunk, chunks)
+		}
+	}
+	err = SACP_start_upload_reader(sc.conn, payload.Name, io.TeeReader(rc, h), payload.Size, SACPTimeout, onProgress)
+	if err == nil {
+		sc.lastName = payload.Name
+		sc.lastMD5 = hex.EncodeToString(h.Sum(nil))
+	}
 	return
 }
 
 func (sc *SACPConnector) SetToolTemperature(tool_id int, temperature int) (err error) {
-	err = SACP_set_tool_temperature(sc.conn, uint8(tool_id), uint16(temperature), SACPTimeout*time.Second)
+	err = SACP_set_tool_temperature(sc.conn, uint8(tool_id), uint16(temperature), SACPTimeout)
 	return
 }
 
 func (sc *SACPConnector) SetBedTemperature(tool_id int, temperature int) (err error) {
-	err = SACP_set_bed_temperature(sc.conn, uint8(tool_id), uint16(temperature), SACPTimeout*time.Second)
+	err = SACP_set_bed_temperature(sc.conn, uint8(tool_id), uint16(temperature), SACPTimeout)
 	return
 }
 
 func (sc *SACPConnector) Home() (err error) {
-	err = SACP_home(sc.conn, SACPTimeout*time.Second)
+	err = SACP_home(sc.conn, SACPTimeout)
 	return
 }
 
+// Status is not supported, SACP pushes the state and the temperatures by
+// subscriptions which are not implemented yet.
+func (sc *SACPConnector) Status() (*PrinterStatus, error) {
+	return nil, errStatusNotSupported
+}
+
+func (sc *SACPConnector) StartPrint(filename string) error {
+	if filename != sc.lastName || sc.lastMD5 == "" {
+		return fmt.Errorf("can not start '%s', only the last uploaded file can be printed", filename)
+	}
+	return SACP_start_screen_print(sc.conn, SACPHeadPrinting, sc.lastName, sc.lastMD5, SACPTimeout)
+}
+
+func (sc *SACPConnector) PausePrint() error {
+	return SACP_pause_print(sc.conn, SACPTimeout)
+}
+
+func (sc *SACPConnector) ResumePrint() error {
+	return SACP_resume_print(sc.conn, SACPTimeout)
+}
+
+func (sc *SACPConnector) StopPrint() error {
+	return SACP_stop_print(sc.conn, SACPTimeout)
+}
+
 func init() {
 	Connector.RegisterHandler(&SACPConnector{})
 }
@@ -0,0 +1,285 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	uploadHistorySize = 50
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+type uploadRecord struct {
+	ID       int64         `json:"id"`
+	Name     string        `json:"name"`
+	Printer  string        `json:"printer"`
+	Protocol string        `json:"protocol"`
+	Size     int64         `json:"size"`
+	Sent     int64         `json:"sent"`
+	Phase    ProgressPhase `json:"phase"`
+	Error    string        `json:"error,omitempty"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished,omitzero"`
+}
+
+// uploadTracker keeps the recent uploads, built from the progress events.
+type uploadTracker struct {
+	mu      sync.Mutex
+	history []*uploadRecord
+}
+
+var uploads = &uploadTracker{}
+
+// run follows the progress events until the process exits.
+func (t *uploadTracker) run() {
+	ch, _ := Progress.Subscribe()
+	for e := range ch {
+		t.update(e)
+	}
+}
+
+func (t *uploadTracker) update(e ProgressEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var rec *uploadRecord
+	for i := len(t.history) - 1; i >= 0; i-- {
+		r := t.history[i]
+		// printer events update the running upload of that printer
+		if (e.Upload != 0 && r.ID == e.Upload) || (e.Upload == 0 && r.Printer == e.Printer && r.Finished.IsZero()) {
+			rec = r
+			break
+		}
+	}
+	if rec == nil {
+		if e.Upload == 0 {
+			return
+		}
+		rec = &uploadRecord{ID: e.Upload, Started: e.Time}
+		t.history = append(t.history, rec)
+		if len(t.history) > uploadHistorySize {
+			t.history = t.history[len(t.history)-uploadHistorySize:]
+		}
+	}
+
+	rec.Phase = e.Phase
+	if e.Upload == 0 {
+		return
+	}
+	rec.Name = e.File
+	rec.Printer = e.Printer
+	rec.Protocol = e.Protocol
+	rec.Sent = e.Sent
+	rec.Size = e.Total
+	rec.Error = e.Error
+	if e.Phase == PhaseDone || e.Phase == PhaseFailed {
+		rec.Finished = e.Time
+	}
+}
+
+func (t *uploadTracker) list() []uploadRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	records := make([]uploadRecord, len(t.history))
+	for i, rec := range t.history {
+		records[i] = *rec
+	}
+	return records
+}
+
+type printerView struct {
+	ID       string `json:"id"`
+	IP       string `json:"ip"`
+	Model    string `json:"model"`
+	Protocol string `json:"protocol"`
+	Default  bool   `json:"default"`
+
+	// background discovery only
+	Online   *bool     `json:"online,omitempty"`
+	LastSeen time.Time `json:"last_seen,omitzero"`
+}
+
+func newPrinterView(p *Printer, isDefault bool) printerView {
+	v := printerView{ID: printerKey(p), IP: p.IP, Model: p.Model, Protocol: p.Protocol(), Default: isDefault}
+	if Registry != nil {
+		var online bool
+		v.LastSeen, online = Registry.State(p)
+		v.Online = &online
+	}
+	return v
+}
+
+// registerDashboard adds the web dashboard and its API to mux, files sent
+// from the dashboard are uploaded through b.
+func registerDashboard(mux *http.ServeMux, b *bridge) {
+	var (
+		ls             = b.ls
+		defaultPrinter = b.printer
+		lookup         = b.lookup
+	)
+
+	go uploads.run()
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
+	})
+
+	mux.HandleFunc("GET /api/sm2uploader/printers", func(w http.ResponseWriter, r *http.Request) {
+		views := []printerView{}
+		hasDefault := false
+		for _, p := range ls.List() {
+			if !permits(r, p) {
+				continue
+			}
+			isDefault := printerKey(p) == printerKey(defaultPrinter)
+			hasDefault = hasDefault || isDefault
+			views = append(views, newPrinterView(p, isDefault))
+		}
+		if !hasDefault && permits(r, defaultPrinter) {
+			views = append([]printerView{newPrinterView(defaultPrinter, true)}, views...)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"version": Version, "printers": views})
+	})
+
+	mux.HandleFunc("GET /api/sm2uploader/printers/{id}/status", func(w http.ResponseWriter, r *http.Request) {
+		printer := lookup(r.PathValue("id"))
+		if printer == nil {
+			notFoundResponse(w, "printer not found")
+			return
+		}
+		if !b.allowed(w, r, printer) {
+			return
+		}
+		status, err := Connector.Status(printer)
+		if err == errConnectorBusy {
+			writeJSON(w, http.StatusOK, &PrinterStatus{State: "BUSY"})
+			return
+		} else if err == errStatusNotSupported {
+			writeJSON(w, http.StatusOK, &PrinterStatus{State: "UNKNOWN"})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusOK, &PrinterStatus{State: "OFFLINE"})
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+
+	mux.HandleFunc("POST /api/sm2uploader/printers/{id}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		printer := lookup(r.PathValue("id"))
+		if printer == nil {
+			notFoundResponse(w, "printer not found")
+			return
+		}
+		if !b.allowed(w, r, printer) {
+			return
+		}
+
+		args := struct {
+			Tool1 int    `json:"tool1"`
+			Tool2 int    `json:"tool2"`
+			Bed   int    `json:"bed"`
+			File  string `json:"file"`
+		}{}
+		if r.ContentLength > 0 {
+			if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+				bedRequestResponse(w, err.Error())
+				return
+			}
+		}
+
+		var err error
+		switch action := r.PathValue("action"); action {
+		case "preheat":
+			err = Connector.PreHeatCommands(printer, args.Tool1, args.Tool2, args.Bed, false)
+		case "home":
+			err = Connector.PreHeatCommands(printer, 0, 0, 0, true)
+		case "start":
+			err = Connector.StartPrint(printer, args.File)
+		case "pause":
+			err = Connector.PausePrint(printer)
+		case "resume":
+			err = Connector.ResumePrint(printer)
+		case "stop":
+			err = Connector.StopPrint(printer)
+		default:
+			notFoundResponse(w, fmt.Sprintf("unknown action '%s'", action))
+			return
+		}
+		if err != nil {
+			internalServerErrorResponse(w, err.Error())
+			return
+		}
+		writeResponse(w, http.StatusOK, `{"done": true}`)
+	})
+
+	mux.HandleFunc("POST /api/sm2uploader/upload", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(maxMemory); err != nil {
+			internalServerErrorResponse(w, err.Error())
+			return
+		}
+
+		printer := lookup(r.FormValue("printer"))
+		if printer == nil {
+			notFoundResponse(w, "printer not found")
+			return
+		}
+		if !b.allowed(w, r, printer) {
+			return
+		}
+
+		file, fd, err := r.FormFile("file")
+		if err != nil {
+			bedRequestResponse(w, err.Error())
+			return
+		}
+		defer file.Close()
+
+		// checkboxes are sent only when checked, turn them into the X-Api-Key switches
+		apiKey := "dashboard"
+		if r.FormValue("fix") == "" {
+			apiKey += ";nofix"
+		}
+		for _, opt := range []string{"preheat", "shutoff", "replacetool", "orcaunload"} {
+			if r.FormValue(opt) == "" {
+				apiKey += ";no" + opt
+			}
+		}
+
+		payload := NewPayload(file, fd.Filename, fd.Size)
+		payload.Print = r.FormValue("print") != ""
+		if err := b.upload(r.Context(), printer, payload, apiKey); err != nil {
+			internalServerErrorResponse(w, err.Error())
+			return
+		}
+		writeResponse(w, http.StatusOK, `{"done": true}`)
+	})
+
+	mux.HandleFunc("GET /api/sm2uploader/uploads", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, uploads.list())
+	})
+
+	mux.HandleFunc("GET /api/sm2uploader/events", handleProgressEvents)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		internalServerErrorResponse(w, err.Error())
+		return
+	}
+	writeResponse(w, status, string(b))
+}
+
+func notFoundResponse(w http.ResponseWriter, err string) {
+	requestLog(w).Warn("Not found", "err", err)
+	http.Error(w, err, http.StatusNotFound)
+}
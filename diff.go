@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// diffMaxEdits limits the search for the shortest diff of a region without
+// unique lines, a region that needs more is shown as replaced.
+const diffMaxEdits = 1000
+
+// diffOp is a line of a diff, kind is ' ', '-' or '+'.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffCount is the size of a diff, a removed line followed by an inserted
+// one is a modified line.
+type diffCount struct {
+	Inserted int `json:"inserted"`
+	Removed  int `json:"removed"`
+	Modified int `json:"modified"`
+}
+
+func (c diffCount) String() string {
+	return fmt.Sprintf("+%d -%d ~%d", c.Inserted, c.Removed, c.Modified)
+}
+
+/*
+diffLines returns the edits from a to b. The lines found once in both are
+matched first, like patience diff does, so the G-code of different layers
+is not mixed up; the regions between them get the shortest diff (Myers).
+*/
+func diffLines(a, b []string) []diffOp {
+	ops := []diffOp{}
+	diffPatience(a, b, &ops)
+	return ops
+}
+
+func diffPatience(a, b []string, ops *[]diffOp) {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	for _, l := range a[:n] {
+		*ops = append(*ops, diffOp{' ', l})
+	}
+	a, b = a[n:], b[n:]
+	m := 0
+	for m < len(a) && m < len(b) && a[len(a)-1-m] == b[len(b)-1-m] {
+		m++
+	}
+	suffix := a[len(a)-m:]
+	a, b = a[:len(a)-m], b[:len(b)-m]
+
+	if anchors := uniqueAnchors(a, b); len(anchors) > 0 {
+		i, j := 0, 0
+		for _, an := range anchors {
+			diffPatience(a[i:an[0]], b[j:an[1]], ops)
+			*ops = append(*ops, diffOp{' ', a[an[0]]})
+			i, j = an[0]+1, an[1]+1
+		}
+		diffPatience(a[i:], b[j:], ops)
+	} else {
+		diffMyers(a, b, ops)
+	}
+
+	for _, l := range suffix {
+		*ops = append(*ops, diffOp{' ', l})
+	}
+}
+
+// uniqueAnchors returns the longest increasing run of the lines that are
+// found once in a and once in b, as index pairs.
+func uniqueAnchors(a, b []string) [][2]int {
+	type seen struct{ inA, inB, j int }
+	lines := make(map[string]*seen, len(a))
+	for _, l := range a {
+		s := lines[l]
+		if s == nil {
+			s = &seen{}
+			lines[l] = s
+		}
+		s.inA++
+	}
+	for j, l := range b {
+		if s := lines[l]; s != nil {
+			s.inB++
+			s.j = j
+		}
+	}
+	pairs := [][2]int{}
+	for i, l := range a {
+		if s := lines[l]; s.inA == 1 && s.inB == 1 {
+			pairs = append(pairs, [2]int{i, s.j})
+		}
+	}
+
+	// patience sorting by the index in b
+	var (
+		tops = []int{}                 // last pair of each pile
+		prev = make([]int, len(pairs)) // pair below on the previous pile
+	)
+	for p, pair := range pairs {
+		k, _ := slices.BinarySearchFunc(tops, pair[1], func(t, j int) int { return pairs[t][1] - j })
+		prev[p] = -1
+		if k > 0 {
+			prev[p] = tops[k-1]
+		}
+		if k == len(tops) {
+			tops = append(tops, p)
+		} else {
+			tops[k] = p
+		}
+	}
+	anchors := make([][2]int, len(tops))
+	for k, p := len(tops)-1, -1; k >= 0; k-- {
+		if p == -1 {
+			p = tops[k]
+		} else {
+			p = prev[p]
+		}
+		anchors[k] = pairs[p]
+	}
+	return anchors
+}
+
+// diffMyers appends the shortest diff from a to b, or a replacement if it
+// needs more than diffMaxEdits edits.
+func diffMyers(a, b []string, ops *[]diffOp) {
+	n, m := len(a), len(b)
+	limit := min(n+m, diffMaxEdits)
+	off := limit + 1
+	v := make([]int, 2*limit+3)
+	trace := [][]int{} // v before step d, for k in -(d-1)..d-1
+	for d := 0; d <= limit; d++ {
+		if d == 0 {
+			trace = append(trace, nil)
+		} else {
+			trace = append(trace, slices.Clone(v[off-d+1:off+d]))
+		}
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				*ops = append(*ops, myersPath(a, b, trace)...)
+				return
+			}
+		}
+	}
+
+	for _, l := range a {
+		*ops = append(*ops, diffOp{'-', l})
+	}
+	for _, l := range b {
+		*ops = append(*ops, diffOp{'+', l})
+	}
+}
+
+// myersPath follows the trace of diffMyers back from the end.
+func myersPath(a, b []string, trace [][]int) []diffOp {
+	rev := []diffOp{}
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		at := func(k int) int { return trace[d][k+d-1] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			rev = append(rev, diffOp{' ', a[x-1]})
+			x, y = x-1, y-1
+		}
+		if x == prevX {
+			rev = append(rev, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			rev = append(rev, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		rev = append(rev, diffOp{' ', a[x-1]})
+		x, y = x-1, y-1
+	}
+	slices.Reverse(rev)
+	return rev
+}
+
+// countDiff returns the size of the diff.
+func countDiff(ops []diffOp) (c diffCount) {
+	removed, inserted := 0, 0
+	flush := func() {
+		mod := min(removed, inserted)
+		c.Modified += mod
+		c.Removed += removed - mod
+		c.Inserted += inserted - mod
+		removed, inserted = 0, 0
+	}
+	for _, op := range ops {
+		switch op.kind {
+		case '-':
+			removed++
+		case '+':
+			inserted++
+		default:
+			flush()
+		}
+	}
+	flush()
+	return
+}
+
+// writeUnifiedDiff writes the diff like "diff -u" with context lines around
+// the changes.
+func writeUnifiedDiff(w io.Writer, from, to string, ops []diffOp, context int) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "--- %s\n+++ %s\n", from, to)
+
+	// lines of a and b before each op
+	posA, posB := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		posA[i+1], posB[i+1] = posA[i], posB[i]
+		if op.kind != '+' {
+			posA[i+1]++
+		}
+		if op.kind != '-' {
+			posB[i+1]++
+		}
+	}
+
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// the hunk ends when the next change is more than 2 contexts away
+		start, end := max(i-context, 0), i
+		for j := i; j < len(ops) && j < end+2*context+1; j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			}
+		}
+		end = min(end+context, len(ops))
+
+		fromLine, fromCount := posA[start]+1, posA[end]-posA[start]
+		toLine, toCount := posB[start]+1, posB[end]-posB[start]
+		if fromCount == 0 {
+			fromLine--
+		}
+		if toCount == 0 {
+			toLine--
+		}
+		fmt.Fprintf(bw, "@@ -%d,%d +%d,%d @@\n", fromLine, fromCount, toLine, toCount)
+		for _, op := range ops[start:end] {
+			bw.WriteByte(op.kind)
+			bw.WriteString(op.line)
+			bw.WriteByte('\n')
+		}
+		i = end
+	}
+	return bw.Flush()
+}
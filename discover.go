@@ -3,14 +3,18 @@ package main
 import (
 	"context"
 	"encoding/binary"
-	"fmt"
-	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+)
+
+const (
+	snapmakerService = "_snapmaker._tcp.local."
 )
 
 /* Discover discovers printers on the network. It returns a slice of
@@ -25,9 +29,41 @@ func Discover(timeout time.Duration) ([]*Printer, error) {
 	)
 
 	// UDP broadcast discovery (Artisan/J1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results := discoverBroadcast(timeout)
+		mu.Lock()
+		printers = append(printers, results...)
+		mu.Unlock()
+	}()
+
+	// mDNS discovery (U1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results := discoverMDNS(timeout)
+		mu.Lock()
+		printers = append(printers, results...)
+		mu.Unlock()
+	}()
+
+	wg.Wait()
+	return printers, nil
+}
+
+// discoverBroadcast sends the UDP discover message on all broadcast
+// addresses and collects the answers until timeout.
+func discoverBroadcast(timeout time.Duration) []*Printer {
+	var (
+		mu       sync.Mutex
+		printers []*Printer
+		wg       sync.WaitGroup
+	)
+
 	addrs, err := getBroadcastAddresses()
 	if err != nil {
-		log.Printf("Error getting broadcast addresses: %v", err)
+		logDiscovery.Warn("Error getting broadcast addresses", "err", err)
 	}
 
 	for _, addr := range addrs {
@@ -36,9 +72,7 @@ func Discover(timeout time.Duration) ([]*Printer, error) {
 			defer wg.Done()
 			results, err := discoverUDP(addr, timeout)
 			if err != nil {
-				if Debug {
-					log.Printf("Error discovering UDP on %s: %v", addr, err)
-				}
+				logDiscovery.Debug("Error discovering UDP", "addr", addr, "err", err)
 				return
 			}
 			mu.Lock()
@@ -47,37 +81,30 @@ func Discover(timeout time.Duration) ([]*Printer, error) {
 		}(addr)
 	}
 
-	// mDNS discovery (U1)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		results := discoverMDNS(timeout)
-		mu.Lock()
-		printers = append(printers, results...)
-		mu.Unlock()
-	}()
-
 	wg.Wait()
-	return printers, nil
+	return printers
 }
 
 func discoverUDP(addr string, timeout time.Duration) ([]*Printer, error) {
 	var printers []*Printer
 
-	broadcastAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", addr, 20054))
+	network := "udp4"
+	if strings.Contains(addr, ":") {
+		network = "udp6" // ff02::1%iface
+	}
+
+	broadcastAddr, err := net.ResolveUDPAddr(network, net.JoinHostPort(addr, "20054"))
 	if err != nil {
 		return printers, err
 	}
 
-	conn, err := net.ListenUDP("udp4", nil)
+	conn, err := net.ListenUDP(network, nil)
 	if err != nil {
 		return printers, err
 	}
 	defer conn.Close()
 
-	if Debug {
-		log.Printf("-- Discovering UDP on %s", broadcastAddr)
-	}
+	logDiscovery.Debug("Discovering UDP", "addr", broadcastAddr)
 
 	conn.SetDeadline(time.Now().Add(timeout))
 
@@ -87,7 +114,7 @@ func discoverUDP(addr string, timeout time.Duration) ([]*Printer, error) {
 
 	buf := make([]byte, 1500)
 	for {
-		n, _, err := conn.ReadFromUDP(buf)
+		n, src, err := conn.ReadFromUDP(buf)
 		if err != nil {
 			if err, ok := err.(net.Error); ok && err.Timeout() {
 				break
@@ -95,14 +122,13 @@ func discoverUDP(addr string, timeout time.Duration) ([]*Printer, error) {
 			return printers, err
 		}
 
-		if Debug {
-			log.Printf("-- Discover UDP got %d bytes %s", n, buf[:n])
-		}
+		logDiscovery.Debug("Discover UDP got", "bytes", n, "data", string(buf[:n]))
 
 		printer, err := NewPrinter(buf[:n])
 		if err != nil {
 			continue
 		}
+		printer.IP = withZone(printer.IP, udpAddrIP(src))
 		printers = append(printers, printer)
 	}
 	return printers, nil
@@ -128,9 +154,7 @@ func discoverMDNS(timeout time.Duration) []*Printer {
 			continue
 		}
 		seen[key] = true
-		if Debug {
-			log.Printf("-- Discover mDNS got: %s @ %s (%s)", printer.ID, printer.IP, printer.Model)
-		}
+		logDiscovery.Debug("Discover mDNS got", "id", printer.ID, "ip", printer.IP, "model", printer.Model)
 		printers = append(printers, printer)
 	}
 	return printers
@@ -147,7 +171,7 @@ func probeZeroconf(ctx context.Context) {
 	entries := make(chan *zeroconf.ServiceEntry)
 	go func() {
 		defer func() { recover() }()
-		_ = resolver.Browse(ctx, "_snapmaker._tcp", "local.", entries)
+		_ = resolver.Browse(ctx, strings.TrimSuffix(snapmakerService, ".local."), "local.", entries)
 	}()
 
 	// Drain entries so the Browse goroutine doesn't block.
@@ -155,137 +179,280 @@ func probeZeroconf(ctx context.Context) {
 	}
 }
 
-// sniffer starts a passive mDNS listener and returns a channel of discovered printers.
+// sniffer starts passive mDNS listeners (224.0.0.251 and ff02::fb on every
+// interface) and returns a channel of discovered printers.
 func sniffer(ctx context.Context) <-chan *Printer {
 	ch := make(chan *Printer, 512)
 
-	conn, err := net.ListenMulticastUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353})
-	if err != nil {
-		close(ch)
-		return ch
+	var conns []*net.UDPConn
+	if conn, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}); err == nil {
+		conns = append(conns, conn)
+	}
+	for _, iface := range multicastInterfaces() {
+		conn, err := net.ListenMulticastUDP("udp6", &iface, &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353})
+		if err != nil {
+			logDiscovery.Debug("mDNS can not listen", "iface", iface.Name, "err", err)
+			continue
+		}
+		conns = append(conns, conn)
 	}
 
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sniff(ctx, conn, ch)
+		}()
+	}
 	go func() {
-		defer conn.Close()
-		defer close(ch)
+		wg.Wait()
+		close(ch)
+	}()
 
-		localIPs := localIPSet()
-		buf := make([]byte, 1500)
+	return ch
+}
 
-		for {
-			if err := conn.SetReadDeadline(time.Now().Add(1 * time.Second)); err != nil {
-				return
-			}
+func sniff(ctx context.Context, conn *net.UDPConn, ch chan<- *Printer) {
+	defer conn.Close()
 
-			n, src, err := conn.ReadFromUDP(buf)
-			if err != nil {
-				if ctx.Err() != nil {
-					return
-				}
-				continue
-			}
+	localIPs := localIPSet()
+	buf := make([]byte, 9000) // mDNS allows jumbo packets
 
-			// Ignore own packets
-			if localIPs[src.IP.String()] {
-				continue
-			}
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(1 * time.Second)); err != nil {
+			return
+		}
 
-			if !strings.Contains(strings.ToLower(string(buf[:n])), "snapmaker") {
-				continue
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
 			}
+			continue
+		}
 
-			if Debug {
-				log.Printf("-- mDNS raw packet from %s (%d bytes): %q", src.IP, n, buf[:n])
-			}
+		// Ignore own packets
+		if localIPs[src.IP.String()] {
+			continue
+		}
 
-			p := parsePrinter(buf[:n], src.IP.String())
-			if p == nil {
-				continue
-			}
+		if !strings.Contains(strings.ToLower(string(buf[:n])), "snapmaker") {
+			continue
+		}
+
+		logDiscovery.Debug("mDNS raw packet", "src", src, "bytes", n, "data", string(buf[:n]))
 
+		for _, p := range parsePrinters(buf[:n], udpAddrIP(src)) {
 			select {
 			case ch <- p:
 			case <-ctx.Done():
 				return
 			}
 		}
-	}()
+	}
+}
 
-	return ch
+// multicastInterfaces returns the interfaces that are up, can multicast and
+// have an IPv6 address.
+func multicastInterfaces() []net.Interface {
+	var result []net.Interface
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return result
+	}
+	for _, iface := range ifs {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && n.IP.To4() == nil {
+				result = append(result, iface)
+				break
+			}
+		}
+	}
+	return result
 }
 
-// parsePrinter extracts a Printer from a raw mDNS packet by parsing
-// length-prefixed DNS TXT records.
-func parsePrinter(raw []byte, srcIP string) *Printer {
-	pairs := parseTXT(raw)
-	if Debug {
-		// log.Printf("-- mDNS TXT pairs: %v", pairs)
+// parsePrinters decodes a mDNS response and builds a Printer for every
+// _snapmaker._tcp instance in it. The PTR, SRV, TXT and A/AAAA records of
+// an instance are correlated by name, they may be spread over the answer
+// and additional sections.
+func parsePrinters(raw []byte, srcIP string) []*Printer {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(raw); err != nil {
+		logDiscovery.Debug("mDNS invalid packet", "src", srcIP, "err", err)
+		return nil
 	}
-	if len(pairs) == 0 {
+	if !msg.Response {
 		return nil
 	}
 
-	model := pairs["machine_type"]
-	hostname := pairs["device_name"]
-	deviceIP := pairs["ip"]
+	var (
+		instances []string // as announced, the maps are keyed by lower case names
+		seen      = map[string]bool{}
+		srvs      = map[string]*dns.SRV{}
+		txts      = map[string]map[string]string{}
+		addrs     = map[string][]string{}
+	)
+	addInstance := func(name string) {
+		if key := strings.ToLower(name); !seen[key] {
+			seen[key] = true
+			instances = append(instances, name)
+		}
+	}
 
-	if hostname == "" {
-		hostname = pairs["sn"]
+	records := append(append(msg.Answer, msg.Ns...), msg.Extra...)
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.PTR:
+			if name == snapmakerService {
+				addInstance(rr.Ptr)
+			}
+		case *dns.SRV:
+			srvs[name] = rr
+			if strings.HasSuffix(name, "."+snapmakerService) {
+				addInstance(rr.Header().Name)
+			}
+		case *dns.TXT:
+			txts[name] = parseTXT(rr.Txt)
+			if strings.HasSuffix(name, "."+snapmakerService) {
+				addInstance(rr.Header().Name)
+			}
+		case *dns.A:
+			addrs[name] = append(addrs[name], rr.A.String())
+		case *dns.AAAA:
+			addrs[name] = append(addrs[name], rr.AAAA.String())
+		}
 	}
-	if !strings.Contains(strings.ToLower(model), "snapmaker") {
-		return nil
+
+	// some firmwares announce the TXT record under another service type
+	if len(instances) == 0 {
+		for _, rr := range records {
+			if txt, ok := rr.(*dns.TXT); ok && strings.Contains(strings.ToLower(parseTXT(txt.Txt)["machine_type"]), "snapmaker") {
+				addInstance(txt.Header().Name)
+			}
+		}
+	}
+
+	var printers []*Printer
+	for _, instance := range instances {
+		key := strings.ToLower(instance)
+		if p := newMDNSPrinter(instance, srvs[key], txts[key], addrs, srcIP); p != nil {
+			printers = append(printers, p)
+		}
 	}
-	if ip := deviceIP; ip != "" {
-		srcIP = ip
+	return printers
+}
+
+// newMDNSPrinter builds the printer of one instance, the address is taken
+// from the A records of the SRV target, then the "ip" TXT key, then the
+// source of the packet.
+func newMDNSPrinter(instance string, srv *dns.SRV, txt map[string]string, addrs map[string][]string, srcIP string) *Printer {
+	if txt == nil {
+		txt = map[string]string{}
 	}
-	if hostname == "" {
-		hostname = "unknown"
+	model := txt["machine_type"]
+	if model != "" && !strings.Contains(strings.ToLower(model), "snapmaker") {
+		return nil
 	}
 
-	return &Printer{
-		IP:        srcIP,
-		ID:        hostname,
+	p := &Printer{
+		ID:        txt["device_name"],
 		Model:     model,
-		Token:     "",
-		Sacp:      false,
 		Moonraker: true,
+		TXT:       txt,
+		Method:    "mdns",
+	}
+	if srv != nil {
+		p.Hostname = strings.TrimSuffix(srv.Target, ".")
+		p.Port = int(srv.Port)
+		p.Addresses = addrs[strings.ToLower(srv.Target)]
 	}
-}
 
-// parseTXT extracts key=value pairs from DNS TXT records in raw bytes.
-// DNS TXT format: each string is a 1-byte length followed by the text.
-func parseTXT(raw []byte) map[string]string {
-	pairs := map[string]string{}
-	for i := 0; i < len(raw)-2; i++ {
-		length := int(raw[i])
-		// Bounds: min 3 (e.g. "a=b"), max 120 to skip DNS header/RDLENGTH bytes.
-		if length < 3 || length > 120 || i+1+length > len(raw) {
-			continue
+	// prefer IPv4, then a global IPv6 address, then link-local
+	for _, addr := range p.Addresses {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+			p.IP = addr
+			break
 		}
-		text := string(raw[i+1 : i+1+length])
-		idx := strings.IndexByte(text, '=')
-		if idx < 1 {
-			continue
+	}
+	for _, addr := range p.Addresses {
+		if ip := net.ParseIP(addr); p.IP == "" && ip != nil && !ip.IsLinkLocalUnicast() {
+			p.IP = addr
 		}
-		key := text[:idx]
-		if looksLikeTXTKey(key) {
-			pairs[key] = text[idx+1:]
+	}
+	if p.IP == "" && len(p.Addresses) > 0 {
+		p.IP = withZone(p.Addresses[0], srcIP)
+	}
+	if p.IP == "" && txt["ip"] != "" {
+		p.IP = withZone(txt["ip"], srcIP)
+	}
+	if p.IP == "" {
+		p.IP = srcIP
+	}
+
+	if p.ID == "" {
+		p.ID = txt["sn"]
+	}
+	if p.ID == "" {
+		p.ID = instanceName(instance)
+	}
+	if p.ID == "" {
+		p.ID = "unknown"
+	}
+	return p
+}
+
+// parseTXT splits the strings of a TXT record into key=value pairs, keys
+// without a value are set to "".
+func parseTXT(txt []string) map[string]string {
+	pairs := make(map[string]string, len(txt))
+	for _, s := range txt {
+		key, value, _ := strings.Cut(s, "=")
+		if key != "" {
+			pairs[key] = value
 		}
 	}
 	return pairs
 }
 
-// looksLikeTXTKey checks if a string looks like a TXT record key.
-func looksLikeTXTKey(s string) bool {
-	if len(s) == 0 {
-		return false
-	}
-	for _, c := range s {
-		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_') {
-			return false
+// instanceName returns the first label of a service instance name without
+// the presentation format escapes, "Snapmaker\ U1._snapmaker._tcp.local."
+// is "Snapmaker U1".
+func instanceName(name string) string {
+	var (
+		b       strings.Builder
+		escaped bool
+	)
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case escaped:
+			escaped = false
+			if c >= '0' && c <= '9' && i+2 < len(name) {
+				if n, err := strconv.Atoi(name[i : i+3]); err == nil && n < 256 {
+					b.WriteByte(byte(n))
+					i += 2
+					continue
+				}
+			}
+			b.WriteByte(c)
+		case c == '\\':
+			escaped = true
+		case c == '.':
+			return b.String()
+		default:
+			b.WriteByte(c)
 		}
 	}
-	return true
+	return b.String()
 }
 
 // localIPSet returns all local IP addresses for filtering own mDNS packets.
@@ -303,6 +470,9 @@ func localIPSet() map[string]bool {
 	return ips
 }
 
+// getBroadcastAddresses returns the IPv4 broadcast address of every
+// interface and the IPv6 all-nodes address ff02::1 with the zone of every
+// interface that has IPv6.
 func getBroadcastAddresses() ([]string, error) {
 	ifs, err := net.Interfaces()
 	if err != nil {
@@ -326,6 +496,10 @@ func getBroadcastAddresses() ([]string, error) {
 		}
 	}
 
+	for _, iface := range multicastInterfaces() {
+		addrMap["ff02::1%"+iface.Name] = true
+	}
+
 	addrs := make([]string, 0, len(addrMap))
 	for addr := range addrMap {
 		addrs = append(addrs, addr)
@@ -13,7 +13,31 @@ var (
 
 func flag_usage() {
 	ex, _ := os.Executable()
-	usage := `%s [options] file1.gcode file2.nc ...
+	usage := `%[1]s [options] file1.gcode file2.nc ...     same as upload, or serve with -octoprint etc.
+%[1]s upload [options] file1.gcode ...
+%[1]s preheat [-tool1 T] [-tool2 T] [-bed T] [-home] [options]
+%[1]s home [options]
+%[1]s status [options]
+%[1]s serve -octoprint :8844 [-moonraker-listen :7125] [-prusalink-listen :8845] [options]
+%[1]s watch-dir <dir> [-host ID] [-watch-poll] [options]
+%[1]s check [-model M | -host ID] [-json] file1.gcode ...
+%[1]s analyze [-model M | -host ID] [-json] file1.gcode ...
+%[1]s thumbnail [-o file.png] [-render] [-size WxH] [-model M | -host ID] file1.gcode ...
+%[1]s fix [-fix stages] [-model M | -host ID] [-output dir] [-diff | -json] file1.gcode ...
+%[1]s discover [-timeout 4s] [-json] [-save]
+%[1]s hosts list|add|remove|rename|set|rotate-token|encrypt ...
+%[1]s config show [-json] [options]
+
+Exit codes:
+  0  success
+  1  other error
+  2  invalid input (options, files, config)
+  3  printer not found
+  4  access denied by the printer
+  5  transfer failed
+  6  G-code fix failed
+  7  the file does not fit the printer (preflight), see -force
+  130  interrupted (SIGINT), 128 + the number of other signals
 
 %s <https://github.com/macdylan/sm2uploader>
 
@@ -21,5 +45,4 @@ Options:
 `
 	fmt.Printf(usage, filepath.Base(ex), Version)
 	flag.PrintDefaults()
-	os.Exit(1)
 }
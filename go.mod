@@ -3,11 +3,14 @@ module github.com/macdylan/sm2uploader
 go 1.24.0
 
 require (
-	github.com/gosuri/uilive v0.0.4
+	github.com/fsnotify/fsnotify v1.10.1
 	github.com/grandcat/zeroconf v1.0.0
 	github.com/imroc/req/v3 v3.57.0
 	github.com/macdylan/SMFix/fix v0.0.0-20260531180817-56e603d8c5eb
 	github.com/manifoldco/promptui v0.9.0
+	github.com/mattn/go-isatty v0.0.19
+	github.com/miekg/dns v1.1.27
+	golang.org/x/sys v0.39.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -19,13 +22,10 @@ require (
 	github.com/icholy/digest v1.1.0 // indirect
 	github.com/klauspost/compress v1.18.2 // indirect
 	github.com/kr/text v0.2.0 // indirect
-	github.com/mattn/go-isatty v0.0.19 // indirect
-	github.com/miekg/dns v1.1.27 // indirect
 	github.com/quic-go/qpack v0.6.0 // indirect
 	github.com/quic-go/quic-go v0.57.1 // indirect
 	github.com/refraction-networking/utls v1.8.1 // indirect
 	golang.org/x/crypto v0.46.0 // indirect
 	golang.org/x/net v0.48.0 // indirect
-	golang.org/x/sys v0.39.0 // indirect
 	golang.org/x/text v0.32.0 // indirect
 )
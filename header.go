@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/macdylan/SMFix/fix"
+)
+
+// thumbnail is an image the slicer embedded in the G-code.
+type thumbnail struct {
+	Width, Height int
+	Format        string // PNG, JPG or QOI
+	Data          []byte
+}
+
+var (
+	// ; thumbnail begin 300x300 12345, ; thumbnail_JPG begin 300x300 12345
+	reThumbnailBegin = regexp.MustCompile(`^;\s*thumbnail(?:_(\w+))? begin (\d+)[x ](\d+)`)
+	reThumbnailEnd   = regexp.MustCompile(`^;\s*thumbnail(?:_\w+)? end`)
+)
+
+const pngDataURL = "data:image/png;base64,"
+
+// previewSize returns the size of the preview image of the touchscreen of
+// model, a key of machineEnvelopes.
+func previewSize(model string) (width, height int) {
+	switch model {
+	case "J1", "U1":
+		return 300, 300
+	}
+	return 300, 150
+}
+
+/*
+extractThumbnails returns the images in the comments before the first
+command of the G-code in data: the "; thumbnail begin" blocks of PrusaSlicer,
+OrcaSlicer and the Cura thumbnail script, and the data URL of the Snapmaker
+headers. Images that can not be decoded are skipped.
+*/
+func extractThumbnails(data []byte) []thumbnail {
+	var (
+		thumbs []thumbnail
+		cur    *thumbnail
+		b64    strings.Builder
+	)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64<<10), 16<<20) // the Snapmaker headers have the image on one line
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, ";") {
+			break // the thumbnails are in the header
+		}
+
+		switch {
+		case cur != nil && reThumbnailEnd.MatchString(line):
+			if b, err := base64.StdEncoding.DecodeString(b64.String()); err == nil {
+				cur.Data = b
+				thumbs = append(thumbs, *cur)
+			}
+			cur = nil
+		case cur != nil:
+			b64.WriteString(strings.TrimSpace(strings.TrimPrefix(line, ";")))
+		case reThumbnailBegin.MatchString(line):
+			m := reThumbnailBegin.FindStringSubmatch(line)
+			cur = &thumbnail{Format: "PNG"}
+			if m[1] != "" {
+				cur.Format = strings.ToUpper(m[1])
+			}
+			cur.Width, _ = strconv.Atoi(m[2])
+			cur.Height, _ = strconv.Atoi(m[3])
+			b64.Reset()
+		case strings.HasPrefix(strings.ToLower(line), ";thumbnail:"):
+			_, v, ok := strings.Cut(line, pngDataURL)
+			if !ok {
+				continue
+			}
+			b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+			if err != nil {
+				continue
+			}
+			if cfg, err := png.DecodeConfig(bytes.NewReader(b)); err == nil {
+				thumbs = append(thumbs, thumbnail{Width: cfg.Width, Height: cfg.Height, Format: "PNG", Data: b})
+			}
+		}
+	}
+	return thumbs
+}
+
+// bestThumbnail returns the largest PNG or JPEG thumbnail as PNG, or nil.
+func bestThumbnail(thumbs []thumbnail) []byte {
+	var best *thumbnail
+	for i, t := range thumbs {
+		if t.Format != "PNG" && t.Format != "JPG" {
+			continue
+		}
+		if best == nil || t.Width*t.Height > best.Width*best.Height {
+			best = &thumbs[i]
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	if best.Format == "PNG" {
+		return best.Data
+	}
+	img, err := jpeg.Decode(bytes.NewReader(best.Data))
+	if err != nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// previewPNG returns the embedded thumbnail of the G-code, or a rendered
+// preview in the size of the touchscreen of model.
+func previewPNG(data []byte, name, model string) ([]byte, error) {
+	if b := bestThumbnail(extractThumbnails(data)); b != nil {
+		return b, nil
+	}
+	w, h := previewSize(machineModel(model))
+	return renderPreview(data, name, model, w, h)
+}
+
+// snapmakerModels are the models of the Snapmaker headers by the key of
+// machineEnvelopes.
+var snapmakerModels = map[string]string{
+	"A150":    fix.ModelA150,
+	"A250":    fix.ModelA250,
+	"A350":    fix.ModelA350,
+	"Artisan": fix.ModelA400,
+	"J1":      fix.ModelJ1,
+	"U1":      fix.ModelU1,
+}
+
+/*
+snapmakerHeader returns the Snapmaker header for model, the printer of the
+upload, from the analysis of the G-code in data with lines lines. It is
+used when SMFix can not read the settings of the slicer, like in files of
+Cura, so the values the file does not have are defaults: 0.4 mm nozzles,
+PLA and no retraction. The J1 gets the version 1 header, like SMFix does.
+*/
+func snapmakerHeader(data []byte, model string, lines int, log *slog.Logger) ([][]byte, error) {
+	s, err := analyzeGcode(bytes.NewReader(data), ".gcode", model)
+	if err != nil {
+		return nil, err
+	}
+	m := machineModel(model)
+	if m == "" {
+		m = machineModel(s.Model)
+	}
+	if m == "" {
+		return nil, fmt.Errorf("unknown printer model '%s'", model)
+	}
+
+	thumb := bestThumbnail(extractThumbnails(data))
+	if thumb == nil {
+		w, h := previewSize(m)
+		if thumb, err = renderPreview(data, ".gcode", m, w, h); err != nil {
+			log.Warn("No preview", "err", err)
+		}
+	}
+
+	est := s.Time
+	if s.SlicerTime > 0 {
+		est = s.SlicerTime
+	}
+	layerHeight := s.Min[2]
+	if s.Layers > 1 {
+		layerHeight = (s.Max[2] - s.Min[2]) / float64(s.Layers-1)
+	}
+	var length, weight float64
+	for _, t := range s.Tools {
+		_, w := s.filament(t)
+		length += s.Extrusion[t]
+		weight += w
+	}
+	material := func(t int) string {
+		if s.Extrusion[t] > 0 {
+			return "PLA"
+		}
+		return "-"
+	}
+	toolHead := fix.ToolheadSingle
+	if len(s.Tools) > 1 || s.dual {
+		toolHead = fix.ToolheadDual
+	}
+
+	var h []string
+	if m == "J1" {
+		h = []string{
+			fix.Mark,
+			";Header Start",
+			";Version:1",
+			";Printer:" + snapmakerModels[m],
+			fmt.Sprintf(";Estimated Print Time:%.0f", est),
+			"", // lines
+			";Extruder Mode:" + fix.PrintModeDefault,
+		}
+		for t := range 2 {
+			h = append(h,
+				fmt.Sprintf(";Extruder %d Nozzle Size:0.4", t),
+				fmt.Sprintf(";Extruder %d Material:%s", t, material(t)),
+				fmt.Sprintf(";Extruder %d Print Temperature:%.0f", t, s.Nozzle[t]),
+				fmt.Sprintf(";Extruder %d Retraction Distance:0.00", t),
+				fmt.Sprintf(";Extruder %d Switch Retraction Distance:0.00", t),
+			)
+		}
+		h = append(h,
+			fmt.Sprintf(";Bed Temperature:%.0f", s.Bed),
+			fmt.Sprintf(";Work Range - Min X:%.4f", s.Min[0]),
+			fmt.Sprintf(";Work Range - Min Y:%.4f", s.Min[1]),
+			fmt.Sprintf(";Work Range - Min Z:%.4f", s.Min[2]),
+			fmt.Sprintf(";Work Range - Max X:%.4f", s.Max[0]),
+			fmt.Sprintf(";Work Range - Max Y:%.4f", s.Max[1]),
+			fmt.Sprintf(";Work Range - Max Z:%.4f", s.Max[2]),
+			fmt.Sprintf(";Extruder(s) Used:%d", max(len(s.Tools), 1)),
+		)
+		if thumb != nil {
+			h = append(h, ";Thumbnail:"+pngDataURL+base64.StdEncoding.EncodeToString(thumb))
+		}
+		h = append(h, ";Header End\n\n")
+		h[5] = fmt.Sprintf(";Lines:%d", lines+len(h))
+	} else {
+		h = []string{
+			fix.Mark,
+			";Header Start",
+			";FAVOR:Marlin",
+			fmt.Sprintf(";TIME:%.0f", est),
+			fmt.Sprintf(";Filament used: %.5fm", length/1000),
+			fmt.Sprintf(";Layer height: %.2f", layerHeight),
+			";header_type: 3dp",
+			";tool_head: " + toolHead,
+			";machine: " + snapmakerModels[m],
+			"", // lines
+			fmt.Sprintf(";estimated_time(s): %.0f", est),
+			fmt.Sprintf(";nozzle_temperature(°C): %.0f", s.Nozzle[0]),
+		}
+		for t := range 2 {
+			if t == 1 {
+				h = append(h, fmt.Sprintf(";nozzle_1_temperature(°C): %.0f", s.Nozzle[1]))
+			}
+			h = append(h,
+				fmt.Sprintf(";nozzle_%d_diameter(mm): 0.4", t),
+				fmt.Sprintf(";nozzle_%d_material: %s", t, material(t)),
+				fmt.Sprintf(";Extruder %d Retraction Distance: 0.00", t),
+				fmt.Sprintf(";Extruder %d Switch Retraction Distance: 0.00", t),
+			)
+		}
+		h = append(h,
+			fmt.Sprintf(";build_plate_temperature(°C): %.0f", s.Bed),
+			";work_speed(mm/minute): 0",
+			fmt.Sprintf(";max_x(mm): %.4f", s.Max[0]),
+			fmt.Sprintf(";max_y(mm): %.4f", s.Max[1]),
+			fmt.Sprintf(";max_z(mm): %.4f", s.Max[2]),
+			fmt.Sprintf(";min_x(mm): %.4f", s.Min[0]),
+			fmt.Sprintf(";min_y(mm): %.4f", s.Min[1]),
+			fmt.Sprintf(";min_z(mm): %.4f", s.Min[2]),
+			fmt.Sprintf(";layer_number: %d", s.Layers),
+			fmt.Sprintf(";layer_height: %.2f", layerHeight),
+			fmt.Sprintf(";matierial_weight: %.4f", weight),
+			fmt.Sprintf(";matierial_length: %.5f", length/1000),
+		)
+		if thumb != nil {
+			h = append(h, ";thumbnail: "+pngDataURL+base64.StdEncoding.EncodeToString(thumb))
+		}
+		h = append(h, ";Header End\n\n")
+		h[9] = fmt.Sprintf(";file_total_lines: %d", lines+len(h))
+	}
+
+	headers := make([][]byte, len(h))
+	for i, line := range h {
+		headers[i] = []byte(line)
+	}
+	return headers, nil
+}
+
+// withThumbnail adds the PNG to the header of SMFix, which has none.
+func withThumbnail(headers [][]byte, thumb []byte) [][]byte {
+	key := ";thumbnail: "
+	if fix.Params.Version == 1 {
+		key = ";Thumbnail:"
+	}
+	line := []byte(key + pngDataURL + base64.StdEncoding.EncodeToString(thumb))
+	end := len(headers) - 1 // ;Header End
+	return append(headers[:end:end], line, headers[end])
+}
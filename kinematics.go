@@ -0,0 +1,205 @@
+package main
+
+import "math"
+
+/*
+kinematics are the motion limits of a machine, close to the defaults of its
+firmware. M201, M203, M204, M205 J and SET_VELOCITY_LIMIT in the file
+change them, slicers usually set them in the start G-code.
+*/
+type kinematics struct {
+	MaxSpeed          [4]float64 // X, Y, Z, E (mm/s)
+	MaxAccel          [4]float64 // X, Y, Z, E (mm/s²)
+	Accel             float64    // printing moves (mm/s²)
+	Travel            float64    // travel moves (mm/s²)
+	Retract           float64    // extruder only moves (mm/s²)
+	JunctionDeviation float64    // mm
+}
+
+// kinematics of the A-series, also used for unknown models
+var aSeriesKinematics = kinematics{
+	MaxSpeed:          [4]float64{150, 150, 40, 25},
+	MaxAccel:          [4]float64{1000, 1000, 100, 10000},
+	Accel:             1000,
+	Travel:            1000,
+	Retract:           1000,
+	JunctionDeviation: 0.05,
+}
+
+// machineKinematics by the key of machineEnvelopes
+var machineKinematics = map[string]kinematics{
+	"A150": aSeriesKinematics,
+	"A250": aSeriesKinematics,
+	"A350": aSeriesKinematics,
+	"Artisan": {
+		MaxSpeed:          [4]float64{200, 200, 40, 40},
+		MaxAccel:          [4]float64{3000, 3000, 100, 10000},
+		Accel:             3000,
+		Travel:            3000,
+		Retract:           3000,
+		JunctionDeviation: 0.05,
+	},
+	"J1": {
+		MaxSpeed:          [4]float64{350, 350, 30, 40},
+		MaxAccel:          [4]float64{10000, 10000, 100, 10000},
+		Accel:             5000,
+		Travel:            10000,
+		Retract:           3000,
+		JunctionDeviation: 0.05,
+	},
+	"U1": {
+		MaxSpeed:          [4]float64{500, 500, 30, 50},
+		MaxAccel:          [4]float64{20000, 20000, 500, 5000},
+		Accel:             10000,
+		Travel:            10000,
+		Retract:           5000,
+		JunctionDeviation: 0.05,
+	},
+}
+
+// moves planned together, like the lookahead buffer of the firmware
+const plannerWindow = 16
+
+type plannedMove struct {
+	length   float64 // mm
+	nominal  float64 // mm/s
+	accel    float64 // mm/s²
+	maxEntry float64 // limited by the junction with the previous move
+	entry    float64
+}
+
+/*
+planner estimates how long the moves take on the machine: a move speeds up
+and slows down at its acceleration, the speed at the junction of two moves
+is limited by the angle between them (junction deviation), and the speeds
+are planned over a window of moves, like the firmware does.
+*/
+type planner struct {
+	k       kinematics
+	queue   []plannedMove
+	dir     [3]float64 // unit vector of the last move, zero after a stop
+	nominal float64    // speed of the last move
+	entry   float64    // entry speed of queue[0], the moves before it ran
+	time    float64    // seconds
+}
+
+func newPlanner(k kinematics) *planner {
+	return &planner{k: k}
+}
+
+// move adds a move by delta (mm) with the length of its path, which is
+// longer than delta for arcs, that extrudes e (mm) at feed (mm/s).
+func (p *planner) move(delta [3]float64, length, e, feed, accel float64) {
+	if feed <= 0 {
+		feed = p.k.MaxSpeed[0]
+	}
+	if length < 1e-6 {
+		if e != 0 { // retraction or priming
+			p.flush()
+			p.time += trapezoid(math.Abs(e), 0, 0, min(feed, p.k.MaxSpeed[3]), min(p.k.Retract, p.k.MaxAccel[3]))
+		}
+		return
+	}
+
+	var dir [3]float64
+	if chord := math.Sqrt(delta[0]*delta[0] + delta[1]*delta[1] + delta[2]*delta[2]); chord > 1e-9 {
+		for i := range delta {
+			dir[i] = delta[i] / chord
+		}
+	}
+	speed := feed
+	ratio := [4]float64{math.Abs(dir[0]), math.Abs(dir[1]), math.Abs(dir[2]), math.Abs(e) / length}
+	for i, r := range ratio {
+		if r > 1e-9 {
+			speed = min(speed, p.k.MaxSpeed[i]/r)
+			accel = min(accel, p.k.MaxAccel[i]/r)
+		}
+	}
+
+	maxEntry := 0.0
+	if p.dir != ([3]float64{}) && dir != ([3]float64{}) {
+		cos := -(p.dir[0]*dir[0] + p.dir[1]*dir[1] + p.dir[2]*dir[2])
+		switch {
+		case cos > 0.999999: // reverses
+		case cos < -0.999999: // straight on
+			maxEntry = min(speed, p.nominal)
+		default:
+			sinHalf := math.Sqrt(0.5 * (1 - cos))
+			maxEntry = min(math.Sqrt(accel*p.k.JunctionDeviation*sinHalf/(1-sinHalf)), speed, p.nominal)
+		}
+	}
+	p.queue = append(p.queue, plannedMove{length: length, nominal: speed, accel: accel, maxEntry: maxEntry})
+	p.dir, p.nominal = dir, speed
+
+	if len(p.queue) >= 2*plannerWindow {
+		p.plan()
+		p.run(plannerWindow)
+	}
+}
+
+// dwell stops the machine for d seconds.
+func (p *planner) dwell(d float64) {
+	p.flush()
+	p.time += max(d, 0)
+}
+
+// flush runs the queued moves until the machine stands still.
+func (p *planner) flush() {
+	if len(p.queue) > 0 {
+		p.plan()
+		p.run(len(p.queue))
+	}
+	p.dir = [3]float64{}
+}
+
+// plan sets the entry speeds of the queue, the last move must be able to
+// stop since the moves after it are unknown.
+func (p *planner) plan() {
+	next := 0.0
+	for i := len(p.queue) - 1; i >= 0; i-- {
+		m := &p.queue[i]
+		m.entry = min(m.maxEntry, math.Sqrt(next*next+2*m.accel*m.length))
+		next = m.entry
+	}
+	p.queue[0].entry = min(p.queue[0].entry, p.entry)
+	for i := 1; i < len(p.queue); i++ {
+		prev := &p.queue[i-1]
+		p.queue[i].entry = min(p.queue[i].entry, math.Sqrt(prev.entry*prev.entry+2*prev.accel*prev.length))
+	}
+}
+
+// run adds the time of the first n moves and removes them from the queue.
+func (p *planner) run(n int) {
+	for i, m := range p.queue[:n] {
+		exit := 0.0
+		if i+1 < len(p.queue) {
+			exit = p.queue[i+1].entry
+		}
+		p.time += trapezoid(m.length, m.entry, exit, m.nominal, m.accel)
+	}
+	p.entry = 0
+	if n < len(p.queue) {
+		p.entry = p.queue[n].entry
+	}
+	p.queue = append(p.queue[:0], p.queue[n:]...)
+}
+
+// trapezoid returns the time of a move of length at up to speed v, which
+// starts at v0 and ends at v1, accelerating at a.
+func trapezoid(length, v0, v1, v, a float64) float64 {
+	if v <= 0 {
+		return 0
+	}
+	if a <= 0 {
+		return length / v
+	}
+	v0, v1 = min(v0, v), min(v1, v)
+	accel := (v*v - v0*v0) / (2 * a)
+	decel := (v*v - v1*v1) / (2 * a)
+	if accel+decel <= length {
+		return (v-v0)/a + (v-v1)/a + (length-accel-decel)/v
+	}
+	// v is not reached
+	peak := max(math.Sqrt((2*a*length+v0*v0+v1*v1)/2), v0, v1)
+	return (peak-v0)/a + (peak-v1)/a
+}
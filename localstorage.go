@@ -1,30 +1,159 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 
 	"gopkg.in/yaml.v3"
 )
 
+// hostsVersion is the schema version of the known hosts file, files
+// without a version are version 0.
+const hostsVersion = 1
+
+// hostsMigrations[v] upgrades the printers of a version v file to v+1.
+var hostsMigrations = []func([]*Printer) []*Printer{
+	// 0 -> 1: printers without an ID can not be found, duplicate IDs hide
+	// each other (the last one wins), addresses are saved without brackets
+	func(printers []*Printer) []*Printer {
+		var (
+			result []*Printer
+			index  = map[string]int{}
+		)
+		for _, p := range printers {
+			if p == nil || p.ID == "" {
+				continue
+			}
+			p.IP = normalizeHost(p.IP)
+			if i, ok := index[p.ID]; ok {
+				result[i] = p
+				continue
+			}
+			index[p.ID] = len(result)
+			result = append(result, p)
+		}
+		return result
+	},
+}
+
+/*
+LocalStorage is the known hosts file. Several processes may use the same
+file (e.g. the CLI and a running OctoPrint server): Save holds a lock on
+<file>.lock, merges the changes saved by the others since the file was
+loaded, keeps the replaced file as <file>.bak and replaces the file
+atomically.
+
+Tokens are encrypted in the file if there is a key, see loadTokenKey.
+*/
 type LocalStorage struct {
-	Printers []*Printer `yaml:"printers"`
+	Printers []*Printer
 	savePath string
+	mu       sync.Mutex
 	byID     map[string]*Printer
 	byIP     map[string]*Printer
+	saved    map[string][]byte // printers as loaded or saved last, by id
+	tokens   *tokenCipher
+}
+
+// hostsFile is the content of the known hosts file.
+type hostsFile struct {
+	Version  int        `yaml:"version"`
+	Printers []*Printer `yaml:"printers"`
 }
 
-func NewLocalStorage(savePath string) *LocalStorage {
+// NewLocalStorage loads savePath, a missing file is empty. A file that can
+// not be parsed is an error, it is not overwritten.
+func NewLocalStorage(savePath string) (*LocalStorage, error) {
+	aead, err := loadTokenKey(savePath)
+	if err != nil {
+		return nil, err
+	}
 	s := &LocalStorage{
 		Printers: []*Printer{},
 		savePath: savePath,
+		tokens:   newTokenCipher(aead),
 	}
 
-	if b, err := os.ReadFile(savePath); err == nil {
-		yaml.Unmarshal(b, &s)
+	printers, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	if printers != nil {
+		s.Printers = printers
 	}
 
 	s.rebuildIndex()
-	return s
+	s.saved = snapshotPrinters(s.Printers)
+	return s, nil
+}
+
+// read returns the migrated printers of the file with decrypted tokens, nil
+// if the file does not exist.
+func (ls *LocalStorage) read() ([]*Printer, error) {
+	path := ls.savePath
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, fmt.Errorf("known hosts %s is empty%s", path, backupHint(path))
+	}
+
+	var f hostsFile
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("known hosts %s is malformed: %w%s", path, err, backupHint(path))
+	}
+	if f.Version > hostsVersion {
+		return nil, fmt.Errorf("known hosts %s has version %d, this version of sm2uploader reads up to %d", path, f.Version, hostsVersion)
+	}
+	for v := f.Version; v < hostsVersion; v++ {
+		f.Printers = hostsMigrations[v](f.Printers)
+	}
+	for _, p := range f.Printers {
+		if p.Token, err = ls.tokens.open(p.Token); err != nil {
+			return nil, fmt.Errorf("known hosts %s, printer %s: %w", path, p.ID, err)
+		}
+		applyProfileProtocol(p)
+	}
+	if f.Printers == nil {
+		f.Printers = []*Printer{}
+	}
+	return f.Printers, nil
+}
+
+func backupHint(path string) string {
+	if _, err := os.Stat(path + ".bak"); err == nil {
+		return fmt.Sprintf(", the last good copy is %s.bak", path)
+	}
+	return ""
+}
+
+// encode returns the file content of printers with encrypted tokens.
+func (ls *LocalStorage) encode(printers []*Printer) ([]byte, error) {
+	f := hostsFile{Version: hostsVersion}
+	for _, p := range printers {
+		c := *p
+		c.Token = ls.tokens.seal(p.Token)
+		f.Printers = append(f.Printers, &c)
+	}
+	return yaml.Marshal(f)
+}
+
+func snapshotPrinters(printers []*Printer) map[string][]byte {
+	saved := make(map[string][]byte, len(printers))
+	for _, p := range printers {
+		saved[p.ID], _ = yaml.Marshal(p)
+	}
+	return saved
 }
 
 func (ls *LocalStorage) rebuildIndex() {
@@ -40,8 +169,17 @@ func (ls *LocalStorage) rebuildIndex() {
 	}
 }
 
+// Reindex updates the lookup tables after printers were changed in place.
+func (ls *LocalStorage) Reindex() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.rebuildIndex()
+}
+
 // Add to add printers to LocalStorage
 func (ls *LocalStorage) Add(printers ...*Printer) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
 	for _, p := range printers {
 		if p.ID == "" {
 			continue
@@ -60,6 +198,9 @@ func (ls *LocalStorage) Add(printers ...*Printer) {
 			if p.Token != "" && existing.Token != p.Token {
 				existing.Token = p.Token
 			}
+			if p.Hostname != "" {
+				existing.Hostname, existing.Port = p.Hostname, p.Port
+			}
 		} else {
 			// New printer
 			ls.Printers = append(ls.Printers, p)
@@ -71,19 +212,167 @@ func (ls *LocalStorage) Add(printers ...*Printer) {
 	}
 }
 
-func (ls *LocalStorage) Save() (err error) {
-	if b, err := yaml.Marshal(ls); err == nil {
-		return os.WriteFile(ls.savePath, b, 0644)
+// Save writes the printers to the file, see LocalStorage.
+func (ls *LocalStorage) Save() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	unlock, err := lockFile(ls.savePath + ".lock")
+	if err != nil {
+		return fmt.Errorf("lock known hosts: %w", err)
+	}
+	defer unlock()
+
+	// a malformed file is replaced, but not kept as the backup; it is kept
+	// as <file>.bad instead. The backup is encoded again, tokens that were
+	// saved in plain text get encrypted.
+	var backup []byte
+	current, _ := os.ReadFile(ls.savePath)
+	disk, err := ls.read()
+	if err != nil {
+		if current != nil {
+			if err := writeFileAtomic(ls.savePath+".bad", current, 0600); err != nil {
+				return fmt.Errorf("keep malformed known hosts: %w", err)
+			}
+		}
+		slog.Warn("Replacing known hosts", "err", err, "kept", ls.savePath+".bad")
+	} else if disk != nil {
+		if backup, err = ls.encode(disk); err != nil {
+			return err
+		}
+		ls.merge(disk)
+	}
+
+	b, err := ls.encode(ls.Printers)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(b, current) {
+		ls.saved = snapshotPrinters(ls.Printers)
+		return nil
+	}
+
+	mode := os.FileMode(0600)
+	if st, err := os.Stat(ls.savePath); err == nil {
+		mode = st.Mode().Perm()
+	}
+	if backup != nil {
+		if err := writeFileAtomic(ls.savePath+".bak", backup, mode); err != nil {
+			return fmt.Errorf("backup known hosts: %w", err)
+		}
+	}
+	if err := writeFileAtomic(ls.savePath, b, mode); err != nil {
+		return err
+	}
+	ls.saved = snapshotPrinters(ls.Printers)
+	return nil
+}
+
+// merge takes the changes saved by other processes since the file was
+// loaded, must be called with ls.mu held. A printer changed here keeps the
+// changes of this process.
+func (ls *LocalStorage) merge(disk []*Printer) {
+	onDisk := make(map[string]*Printer, len(disk))
+	for _, d := range disk {
+		onDisk[d.ID] = d
+	}
+
+	printers := make([]*Printer, 0, len(ls.Printers))
+	for _, p := range ls.Printers {
+		d, found := onDisk[p.ID]
+		if saved, ok := ls.saved[p.ID]; ok {
+			if cur, _ := yaml.Marshal(p); bytes.Equal(cur, saved) {
+				if !found {
+					continue // removed by another process
+				}
+				// not changed here, take the file, but keep the fields that are not saved
+				addresses, txt, status, method := p.Addresses, p.TXT, p.Status, p.Method
+				*p = *d
+				p.Addresses, p.TXT, p.Status, p.Method = addresses, txt, status, method
+			}
+		}
+		printers = append(printers, p)
+	}
+	for _, d := range disk {
+		// added by another process
+		if _, ok := ls.saved[d.ID]; !ok && ls.byID[d.ID] == nil {
+			printers = append(printers, d)
+		}
 	}
-	return
+	ls.Printers = printers
+	ls.rebuildIndex()
 }
 
+/*
+Find resolves host to a printer, in order: ID, IP, alias, ID ignoring case
+and a unique ID prefix ignoring case ("j1" finds "J1V19" if no other ID
+starts with "J1").
+*/
 func (ls *LocalStorage) Find(host string) *Printer {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if host == "" {
+		return nil
+	}
 	if p, ok := ls.byID[host]; ok {
 		return p
 	}
 	if p, ok := ls.byIP[host]; ok {
 		return p
 	}
+	for _, p := range ls.Printers {
+		if p.Alias != "" && strings.EqualFold(p.Alias, host) {
+			return p
+		}
+	}
+	for _, p := range ls.Printers {
+		if strings.EqualFold(p.ID, host) {
+			return p
+		}
+	}
+	var found *Printer
+	for _, p := range ls.Printers {
+		if len(p.ID) >= len(host) && strings.EqualFold(p.ID[:len(host)], host) {
+			if found != nil {
+				return nil // ambiguous
+			}
+			found = p
+		}
+	}
+	return found
+}
+
+// Get returns the printer with the exact id.
+func (ls *LocalStorage) Get(id string) *Printer {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.byID[id]
+}
+
+// Remove deletes p from LocalStorage.
+func (ls *LocalStorage) Remove(p *Printer) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.Printers = slices.DeleteFunc(ls.Printers, func(e *Printer) bool { return e == p })
+	ls.rebuildIndex()
+}
+
+// Rename changes the ID of p, the ID must not be in use.
+func (ls *LocalStorage) Rename(p *Printer, id string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if other, ok := ls.byID[id]; ok && other != p {
+		return fmt.Errorf("printer '%s' already exists", id)
+	}
+	p.ID = id
+	ls.rebuildIndex()
 	return nil
 }
+
+// List returns a copy of the printers slice, safe to range over while the
+// discovery loop adds printers.
+func (ls *LocalStorage) List() []*Printer {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return append([]*Printer(nil), ls.Printers...)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mattn/go-isatty"
+)
+
+var (
+	LogLevel  string
+	LogFormat string
+
+	logLevel  = new(slog.LevelVar)
+	logOutput atomic.Pointer[slog.Handler] // handler of -log-format
+	logTerm   = &terminal{w: os.Stderr}
+
+	// loggers of the subsystems, the default logger has no subsystem
+	logDiscovery = subsystemLogger("discovery")
+	logSACP      = subsystemLogger("sacp")
+	logHTTP      = subsystemLogger("http")
+	logMoonraker = subsystemLogger("moonraker")
+	logOctoPrint = subsystemLogger("octoprint")
+	logPrusaLink = subsystemLogger("prusalink")
+	logSMFix     = subsystemLogger("smfix")
+	logPreflight = subsystemLogger("preflight")
+	logWatch     = subsystemLogger("watch")
+)
+
+func init() {
+	var h slog.Handler = &consoleHandler{w: logTerm}
+	logOutput.Store(&h)
+	// the log package writes to the default logger too
+	slog.SetDefault(slog.New(&logHandler{}))
+}
+
+// logFlags defines -log-level and -log-format on set.
+func logFlags(set *flag.FlagSet) {
+	set.StringVar(&LogLevel, "log-level", envOr("LOG_LEVEL", "info"), "log level: debug, info, warn or error")
+	set.StringVar(&LogFormat, "log-format", envOr("LOG_FORMAT", "text"), "log format: text or json")
+}
+
+// setupLogging applies -log-level, -log-format and -debug, which is the same
+// as -log-level debug. The uploads in progress are drawn at the bottom of
+// the terminal if the log is text.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(LogLevel)); err != nil {
+		return invalidInput("-log-level %s, use debug, info, warn or error", LogLevel)
+	}
+	if Debug {
+		level = slog.LevelDebug
+	}
+	logLevel.Set(level)
+	Debug = level <= slog.LevelDebug
+
+	var h slog.Handler
+	switch LogFormat {
+	case "text":
+		h = &consoleHandler{w: logTerm}
+		if isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd()) {
+			atExit(renderProgress(logTerm))
+		}
+	case "json":
+		h = slog.NewJSONHandler(logTerm, &slog.HandlerOptions{Level: logLevel})
+	default:
+		return invalidInput("-log-format %s, use text or json", LogFormat)
+	}
+	logOutput.Store(&h)
+	return nil
+}
+
+func subsystemLogger(name string) *slog.Logger {
+	return slog.New(&logHandler{}).With("subsystem", name)
+}
+
+// logHandler sends the records to the handler of -log-format, so loggers
+// can be created before the options are parsed.
+type logHandler struct {
+	wrap []func(slog.Handler) slog.Handler // WithAttrs and WithGroup in order
+}
+
+func (h *logHandler) handler() slog.Handler {
+	out := *logOutput.Load()
+	for _, wrap := range h.wrap {
+		out = wrap(out)
+	}
+	return out
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler().Handle(ctx, r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logHandler{wrap: append(slices.Clip(h.wrap), func(out slog.Handler) slog.Handler { return out.WithAttrs(attrs) })}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return &logHandler{wrap: append(slices.Clip(h.wrap), func(out slog.Handler) slog.Handler { return out.WithGroup(name) })}
+}
+
+/*
+consoleHandler writes the text log, one line per record:
+
+	2024/01/02 15:04:05 [http] Uploading file=a.gcode size=2.1 MiB
+	2024/01/02 15:04:05 WARN [moonraker] Upload failed err="HTTP 502"
+
+The level is omitted for info.
+*/
+type consoleHandler struct {
+	w         io.Writer
+	subsystem string
+	attrs     []byte // preformatted attributes of WithAttrs
+	group     string // key prefix of WithGroup
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var b bytes.Buffer
+	b.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	if r.Level != slog.LevelInfo {
+		b.WriteString(r.Level.String() + " ")
+	}
+	if h.subsystem != "" {
+		b.WriteString("[" + h.subsystem + "] ")
+	}
+	b.WriteString(r.Message)
+	b.Write(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&b, h.group, a)
+		return true
+	})
+	b.WriteByte('\n')
+	_, err := h.w.Write(b.Bytes())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	var b bytes.Buffer
+	b.Write(h.attrs)
+	for _, a := range attrs {
+		if a.Key == "subsystem" && h.group == "" {
+			c.subsystem = a.Value.String()
+			continue
+		}
+		appendAttr(&b, h.group, a)
+	}
+	c.attrs = b.Bytes()
+	return &c
+}
+
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.group += name + "."
+	return &c
+}
+
+// appendAttr writes a as " key=value", a group as its attributes.
+func appendAttr(b *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			appendAttr(b, prefix, ga)
+		}
+		return
+	}
+	v := a.Value.String()
+	if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+		v = strconv.Quote(v)
+	}
+	b.WriteString(" " + prefix + a.Key + "=" + v)
+}
+
+// terminal serializes the log and the progress line on stderr. The progress
+// line is cleared before a log line is written and drawn again after it.
+type terminal struct {
+	mu       sync.Mutex
+	w        io.Writer
+	progress string // the last line, empty if nothing is in progress
+}
+
+func (t *terminal) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.progress != "" {
+		io.WriteString(t.w, "\r\033[K")
+	}
+	n, err := t.w.Write(p)
+	if t.progress != "" {
+		io.WriteString(t.w, t.progress)
+	}
+	return n, err
+}
+
+// setProgress replaces the progress line.
+func (t *terminal) setProgress(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if line == t.progress {
+		return
+	}
+	io.WriteString(t.w, "\r\033[K"+line)
+	t.progress = line
+}
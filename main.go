@@ -1,258 +1,133 @@
 package main
 
 import (
-	"bytes"
 	"flag"
-	"io"
 	"log"
 	"os"
-	"os/signal"
 	"path/filepath"
-	"syscall"
 	"time"
-
-	"github.com/manifoldco/promptui"
 )
 
 var (
 	Host                string
 	KnownHosts          string
+	ConfigFile          string
 	DiscoverTimeout     time.Duration
+	DiscoverInterval    time.Duration
 	OctoPrintListenAddr string
+	MoonrakerListenAddr string
+	PrusaLinkListenAddr string
+	APIKeysFile         string
+	APIKeyValue         string
 	Tool1Temperature    int
 	Tool2Temperature    int
 	BedTemperature      int
 	Home                bool
 	NoFix               bool
+	DryRun              bool
+	PrintAfterUpload    bool
 	Debug               bool
+	JSONOutput          bool
 	OutputDir           string
+	WatchPoll           bool
+	WatchInterval       time.Duration
+	WatchSettle         time.Duration
 
-	_Payloads       []*Payload
 	SmFixExtensions = map[string]bool{
 		".gcode": true,
 		".nc":    false,
 		".cnc":   false,
 		".bin":   false,
 	}
+
+	// subcommands, the first argument; anything else is an upload
+	commands = map[string]func(args []string) int{
+		"upload":    runUpload,
+		"preheat":   runPreheat,
+		"home":      runHome,
+		"status":    runStatus,
+		"serve":     runServe,
+		"watch-dir": runWatchDir,
+		"check":     runCheck,
+		"analyze":   runAnalyze,
+		"thumbnail": runThumbnail,
+		"fix":       runFix,
+		"discover":  runDiscover,
+		"hosts":     runHosts,
+		"config":    runConfig,
+	}
 )
 
 func main() {
-	defer func() {
-		if r := recover(); r != nil {
-			os.Exit(2)
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			exit(cmd(os.Args[2:]))
 		}
-	}()
-
-	// 获取程序所在目录 - Get the directory where the program is located
-	ex, _ := os.Executable()
-	dir, err := filepath.Abs(filepath.Dir(ex))
-	if err != nil {
-		log.Panicln(err)
-	}
-	defaultKnownHosts := filepath.Join(dir, "hosts.yaml")
-	if envKnownhosts := os.Getenv("KNOWN_HOSTS"); envKnownhosts != "" {
-		defaultKnownHosts = envKnownhosts
 	}
+	// sm2uploader [options] file.gcode ...
+	exit(runDefault(os.Args[1:]))
+}
+
+// exit runs the exit hooks, e.g. clears the progress line, and exits.
+func exit(code int) {
+	runAtExit()
+	os.Exit(code)
+}
+
+// defineFlags defines the options of the upload and server modes.
+func defineFlags() {
+	defaultKnownHosts := defaultKnownHostsPath()
 
 	flag.StringVar(&Host, "host", os.Getenv("HOST"), "upload to host(id/ip/hostname), not required.")
 	flag.StringVar(&KnownHosts, "knownhosts", defaultKnownHosts, "known hosts")
+	flag.StringVar(&ConfigFile, "config", defaultConfigPath(), "config file (yaml), see 'config show'")
 	flag.StringVar(&OctoPrintListenAddr, "octoprint", os.Getenv("OCTOPRINT"), "octoprint listen address, e.g. '-octoprint :8844' then you can upload files to printer by http://localhost:8844")
+	flag.StringVar(&MoonrakerListenAddr, "moonraker-listen", os.Getenv("MOONRAKER_LISTEN"), "moonraker listen address, e.g. '-moonraker-listen :7125' then Klipper-aware slicers can upload files to printer by http://localhost:7125")
+	flag.StringVar(&PrusaLinkListenAddr, "prusalink-listen", os.Getenv("PRUSALINK_LISTEN"), "prusalink listen address, e.g. '-prusalink-listen :8845' for the PrusaSlicer PrusaLink host type")
+	flag.StringVar(&PrusaLinkUser, "prusalink-user", envOr("PRUSALINK_USER", "maker"), "prusalink digest auth user")
+	flag.StringVar(&PrusaLinkPassword, "prusalink-password", os.Getenv("PRUSALINK_PASSWORD"), "prusalink digest auth password, no auth if empty")
+	flag.StringVar(&APIKeysFile, "apikeys", os.Getenv("API_KEYS"), "API keys file (yaml) of the bridge servers, keys may be limited to printers")
+	flag.StringVar(&APIKeyValue, "apikey", os.Getenv("API_KEY"), "API key of the bridge servers, no auth if empty and no -apikeys")
+	flag.BoolVar(&MDNSAnnounce, "mdns", parseBoolEnv("MDNS", true), "announce the octoprint server via mDNS (_octoprint._tcp)")
+	flag.BoolVar(&TLSEnabled, "tls", parseBoolEnv("TLS", false), "serve the bridge over https with a self-signed certificate")
+	flag.StringVar(&TLSCert, "tls-cert", os.Getenv("TLS_CERT"), "TLS certificate file of the bridge servers")
+	flag.StringVar(&TLSKey, "tls-key", os.Getenv("TLS_KEY"), "TLS key file of the bridge servers")
 	flag.IntVar(&Tool1Temperature, "tool1", parseIntEnv("TOOL1", 0), "set the temperature (preheat) of tool 1")
 	flag.IntVar(&Tool2Temperature, "tool2", parseIntEnv("TOOL2", 0), "set the temperature (preheat) of tool 2")
 	flag.IntVar(&BedTemperature, "bed", parseIntEnv("BED", 0), "set the temperature (preheat) of bed")
 	flag.BoolVar(&Home, "home", parseBoolEnv("HOME", false), "home the printer")
 	flag.DurationVar(&DiscoverTimeout, "timeout", parseDurationEnv("TIMEOUT", 4*time.Second), "printer discovery timeout")
+	flag.DurationVar(&DiscoverInterval, "discover-interval", parseDurationEnv("DISCOVER_INTERVAL", 30*time.Second), "background discovery interval in server mode, 0 to disable")
+	flag.StringVar(&ScanCIDRs, "scan", os.Getenv("SCAN"), "scan subnets for printers (comma separated, e.g. 192.168.10.0/24) when broadcast/multicast is blocked, local subnets are scanned if discovery finds nothing")
 	flag.BoolVar(&NoFix, "nofix", parseBoolEnv("NOFIX", false), "disable SMFix(built-in)")
+	fixFlag(flag.CommandLine)
+	flag.BoolVar(&DryRun, "dry-run", parseBoolEnv("DRY_RUN", false), "find the printer, fix and check the files, but do not connect to the printer")
+	flag.BoolVar(&Force, "force", parseBoolEnv("FORCE", false), "upload files that exceed the work area or the limits of the printer")
+	flag.BoolVar(&PrintAfterUpload, "print", parseBoolEnv("PRINT", false), "start printing after upload")
 	flag.StringVar(&OutputDir, "output", os.Getenv("OUTPUT_DIR"), "output directory to save original and fixed files")
-	flag.BoolVar(&Debug, "debug", parseBoolEnv("DEBUG", false), "debug mode")
-
-	flag.Usage = flag_usage
-	flag.Parse()
-
-	if Debug {
-		log.Printf("-- Debug mode: %s", Version)
-	}
-
-	if NoFix {
-		log.Println("!! smfix has been disabled")
-	}
-
-	if OutputDir != "" {
-		log.Printf("Output dir: %s", OutputDir)
-	}
-
-	var printer *Printer
-	ls := NewLocalStorage(KnownHosts)
-	defer func() {
-		if printer != nil {
-			// update printer's token
-			ls.Add(printer)
-			if Debug {
-				log.Printf("-- Updated printer: %s", printer.String())
-			}
-		}
-		if err := ls.Save(); err == nil && Debug {
-			log.Printf("-- Saved known hosts: %s", KnownHosts)
-		}
-	}()
-
-	// Check if host is specified
-	printer = ls.Find(Host)
-	if printer != nil {
-		log.Println("Found printer in " + KnownHosts)
-	}
-
-	// Discover printers
-	if printer == nil {
-		log.Println("Discovering ...")
-		if printers, err := Discover(DiscoverTimeout); err == nil {
-			if Debug {
-				log.Printf("-- Discovered %d printers", len(printers))
-			}
-			ls.Add(printers...)
-		} else if Debug {
-			log.Printf("-- Discover error: %s", err.Error())
-		}
-		printer = ls.Find(Host)
-		if printer != nil {
-			log.Printf("Found printer: %s", printer.String())
-		}
-	}
-
-	if printer == nil {
-		if Host == "" {
-			// Prompt user to select a printer
-			printers := ls.Printers
-			if len(printers) == 0 {
-				log.Panicln("No printers found")
-			}
-			if len(printers) > 1 {
-				prompt := promptui.Select{
-					Label: "Select a printer",
-					Items: printers,
-				}
-				idx, _, err := prompt.Run()
-				if err != nil {
-					log.Panicln(err)
-				}
-				printer = printers[idx]
-			} else {
-				printer = printers[0]
-			}
-		} else {
-			// directly to printer using ip/hostname
-			printer = &Printer{IP: Host}
-		}
-	}
-
-	log.Println("Printer IP:", printer.IP)
-	if printer.Model != "" {
-		log.Println("Printer Model:", printer.Model)
-	}
-
-	// Moonraker/Klipper devices don't need G-Code fix
-	if printer.Moonraker {
-		NoFix = true
-		log.Println("!! Moonraker device detected, smfix disabled")
-	}
-
-	// Create a channel to listen for signals
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	go func() {
-		sig := <-sc
-		log.Printf("Received signal: %s", sig)
-		// update printer's token
-		if printer != nil {
-			ls.Add(printer)
-			if Debug {
-				log.Printf("-- Updated printer: %s", printer.String())
-			}
-		}
-		if err := ls.Save(); err == nil && Debug {
-			log.Printf("-- Saved known hosts: %s", KnownHosts)
-		}
-		os.Exit(0)
-	}()
-
-	if OctoPrintListenAddr != "" {
-		// listen for octoprint uploads
-		if err := startOctoPrintServer(OctoPrintListenAddr, printer); err != nil {
-			log.Panic(err)
-		}
-		return
-	}
+	flag.BoolVar(&WatchPoll, "watch-poll", parseBoolEnv("WATCH_POLL", false), "watch-dir: poll the directory instead of waiting for events, for network shares")
+	flag.DurationVar(&WatchInterval, "watch-interval", parseDurationEnv("WATCH_INTERVAL", 2*time.Second), "watch-dir: how often files are checked")
+	flag.DurationVar(&WatchSettle, "watch-settle", parseDurationEnv("WATCH_SETTLE", 5*time.Second), "watch-dir: how long a file must stop growing before it is uploaded")
+	flag.DurationVar(&SACPTimeout, "sacp-timeout", parseDurationEnv("SACP_TIMEOUT", SACPTimeout), "SACP (J1/Artisan/A-Series with new firmware) request timeout")
+	flag.DurationVar(&HTTPTimeout, "http-timeout", parseDurationEnv("HTTP_TIMEOUT", HTTPTimeout), "HTTP (Snapmaker 2) request timeout")
+	flag.DurationVar(&MoonrakerTimeout, "moonraker-timeout", parseDurationEnv("MOONRAKER_TIMEOUT", MoonrakerTimeout), "Moonraker request timeout, uploads included")
+	flag.BoolVar(&Debug, "debug", parseBoolEnv("DEBUG", false), "debug mode, same as -log-level debug")
+	logFlags(flag.CommandLine)
+	flag.BoolVar(&JSONOutput, "json", parseBoolEnv("JSON", false), "print the result as JSON")
 
-	preheating := Tool1Temperature != 0 || Tool2Temperature != 0 || BedTemperature != 0 || Home
-	if preheating {
-		log.Println("Preheating...")
-		if err := Connector.PreHeatCommands(printer, Tool1Temperature, Tool2Temperature, BedTemperature, Home); err != nil {
-			log.Panic(err)
-		}
-	}
-
-	// 检查文件参数是否存在 - Check if the file parameter exists
-	for _, file := range flag.Args() {
-		if st, err := os.Stat(file); os.IsNotExist(err) {
-			log.Panicf("File %s does not exist\n", file)
-		} else {
-			f, _ := os.Open(file)
-			_Payloads = append(_Payloads, NewPayload(f, st.Name(), st.Size()))
-		}
-	}
+}
 
-	// 检查是否有传入的文件 - Check if a file has been passed in
-	if len(_Payloads) == 0 {
-		if !preheating {
-			log.Panicln("No input files")
-		}
+// defaultKnownHostsPath returns $KNOWN_HOSTS or hosts.yaml in the directory
+// of the executable.
+func defaultKnownHostsPath() string {
+	if envKnownhosts := os.Getenv("KNOWN_HOSTS"); envKnownhosts != "" {
+		return envKnownhosts
 	}
-
-	// 从 slic3r 环境变量中获取文件名
-	envFilename := os.Getenv("SLIC3R_PP_OUTPUT_NAME")
-
-	// Upload files to host
-	for _, p := range _Payloads {
-		if envFilename != "" {
-			p.SetName(filepath.Base(envFilename))
-		}
-
-		// If output directory is specified and the file needs fixing,
-		// pre-process it and save both original and fixed files to disk.
-		// Then set FixedFile so StreamContent can stream from disk instead
-		// of holding the entire content in memory.
-		if OutputDir != "" && p.ShouldBeFix() && !NoFix {
-			// Read original content first (we need to save it before postProcess consumes the reader)
-			origContent, readErr := io.ReadAll(p.File)
-			if readErr != nil {
-				log.Printf("Warning: failed to read '%s' for output: %s", p.Name, readErr)
-			} else {
-				fixedContent, procErr := postProcess(bytes.NewReader(origContent))
-				if procErr != nil {
-					log.Printf("Warning: failed to post-process '%s' for output: %s", p.Name, procErr)
-				} else {
-					fixedPath, saveErr := saveToOutputDir(p.Name, bytes.NewReader(origContent), fixedContent, false)
-					if saveErr != nil {
-						log.Printf("Warning: failed to save to output dir: %s", saveErr)
-					} else if fixedPath != "" {
-						p.FixedFile = fixedPath
-						p.Size = int64(len(fixedContent))
-						log.Printf("Saved fixed: %s/%s_fixed%s",
-							OutputDir, p.Name[:len(p.Name)-len(filepath.Ext(p.Name))], filepath.Ext(p.Name))
-					}
-				}
-			}
-		} else if OutputDir != "" {
-			log.Printf("Skipping output save for '%s' (shouldFix=%v, nofix=%v)",
-				p.Name, p.ShouldBeFix(), NoFix)
-		}
-
-		log.Printf("Uploading file '%s' [%s]...", p.Name, p.ReadableSize())
-		if err := Connector.Upload(printer, p); err != nil {
-			log.Panicln(err)
-		} else {
-			log.Println("Upload finished.")
-			<-time.After(time.Second * 1) // HMI needs some time to refresh
-		}
+	// 获取程序所在目录 - Get the directory where the program is located
+	ex, _ := os.Executable()
+	dir, err := filepath.Abs(filepath.Dir(ex))
+	if err != nil {
+		log.Panicln(err)
 	}
+	return filepath.Join(dir, "hosts.yaml")
 }
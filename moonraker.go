@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// The subset of the Moonraker API used by OrcaSlicer/SuperSlicer, so that
+// Klipper-aware slicers can upload to Snapmaker printers through the bridge.
+// https://moonraker.readthedocs.io/en/latest/web_api/
+
+const (
+	moonrakerAPIVersion = "1.5.0"
+)
+
+var moonrakerObjects = []string{"webhooks", "print_stats", "display_status", "virtual_sdcard", "extruder", "extruder1", "heater_bed"}
+
+func startMoonrakerServer(listenAddr string, b *bridge) error {
+	var (
+		printer = b.printer
+		mux     = http.NewServeMux()
+		start   = time.Now()
+	)
+
+	mux.HandleFunc("GET /server/info", func(w http.ResponseWriter, r *http.Request) {
+		moonrakerResult(w, http.StatusOK, map[string]any{
+			"klippy_connected":       true,
+			"klippy_state":           "ready",
+			"components":             []string{"file_manager", "machine", "octoprint_compat"},
+			"failed_components":      []string{},
+			"registered_directories": []string{"gcodes"},
+			"warnings":               []string{},
+			"websocket_count":        0,
+			"moonraker_version":      "sm2uploader-" + Version,
+			"api_version":            []int{1, 5, 0},
+			"api_version_string":     moonrakerAPIVersion,
+		})
+	})
+
+	mux.HandleFunc("GET /printer/info", func(w http.ResponseWriter, r *http.Request) {
+		moonrakerResult(w, http.StatusOK, map[string]any{
+			"state":            "ready",
+			"state_message":    "Printer is ready",
+			"hostname":         printerKey(printer),
+			"software_version": "sm2uploader " + Version,
+			"cpu_info":         printer.Model,
+		})
+	})
+
+	mux.HandleFunc("GET /printer/objects/list", func(w http.ResponseWriter, r *http.Request) {
+		moonrakerResult(w, http.StatusOK, map[string]any{"objects": moonrakerObjects})
+	})
+
+	mux.HandleFunc("/printer/objects/query", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			methodNotAllowedResponse(w, r.Method)
+			return
+		}
+
+		status, err := Connector.Status(printer)
+		if err == errConnectorBusy {
+			// an upload is running, the printer is idle as far as the slicer knows
+			status = &PrinterStatus{State: "IDLE"}
+		} else if err != nil {
+			status = nil
+		}
+
+		objects := klipperObjects(status)
+		query := r.URL.Query()
+		if len(query) == 0 {
+			for _, name := range moonrakerObjects {
+				query[name] = nil
+			}
+		}
+
+		result := map[string]map[string]any{}
+		for name, attrs := range query {
+			obj, ok := objects[name]
+			if !ok {
+				continue
+			}
+			fields := strings.Split(strings.Join(attrs, ","), ",")
+			if len(fields) == 1 && fields[0] == "" {
+				result[name] = obj
+				continue
+			}
+			result[name] = map[string]any{}
+			for _, f := range fields {
+				if v, ok := obj[f]; ok {
+					result[name][f] = v
+				}
+			}
+		}
+
+		moonrakerResult(w, http.StatusOK, map[string]any{
+			"eventtime": time.Since(start).Seconds(),
+			"status":    result,
+		})
+	})
+
+	mux.HandleFunc("POST /server/files/upload", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(maxMemory); err != nil {
+			moonrakerError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if root := r.FormValue("root"); root != "" && root != "gcodes" {
+			moonrakerError(w, http.StatusBadRequest, "Only the 'gcodes' root is supported")
+			return
+		}
+
+		file, fd, err := r.FormFile("file")
+		if err != nil {
+			moonrakerError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer file.Close()
+
+		if !b.allowed(w, r, printer) {
+			return
+		}
+		// the same SMFix switches as the OctoPrint API
+		apiKey := b.smfixSwitches(r)
+
+		payload := NewPayload(file, fd.Filename, fd.Size)
+		payload.Print = r.FormValue("print") == "true"
+		if err := b.upload(r.Context(), printer, payload, apiKey); err != nil {
+			moonrakerError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		moonrakerResult(w, http.StatusCreated, map[string]any{
+			"item": map[string]any{
+				"path":        path.Join(r.FormValue("path"), payload.Name),
+				"root":        "gcodes",
+				"modified":    time.Now().Unix(),
+				"size":        payload.Size,
+				"permissions": "rw",
+			},
+			"print_started": payload.Print,
+			"print_queued":  false,
+			"action":        "create_file",
+		})
+	})
+
+	// octoprint_compat, some slicers test the connection with it
+	mux.HandleFunc("GET /api/version", func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, http.StatusOK, `{"api": "0.1", "server": "1.5.0", "text": "OctoPrint (Moonraker `+moonrakerAPIVersion+`)"}`)
+	})
+
+	logMoonraker.Info("Starting Moonraker server", "addr", listenAddr)
+	return b.serve(listenAddr, b.requireAPIKey(mux), logMoonraker)
+}
+
+// klipperObjects maps the printer status to Klipper printer objects,
+// status is nil if the printer can not be reached.
+func klipperObjects(status *PrinterStatus) map[string]map[string]any {
+	if status == nil {
+		return map[string]map[string]any{
+			"webhooks":    {"state": "shutdown", "state_message": "Printer is not available"},
+			"print_stats": {"state": "error", "filename": "", "message": "Printer is not available"},
+		}
+	}
+
+	state := "standby"
+	switch strings.ToUpper(status.State) {
+	case "RUNNING", "PRINTING":
+		state = "printing"
+	case "PAUSED", "PAUSING":
+		state = "paused"
+	case "STOPPED", "CANCELLED":
+		state = "cancelled"
+	case "COMPLETE", "COMPLETED":
+		state = "complete"
+	case "ERROR":
+		state = "error"
+	}
+
+	objects := map[string]map[string]any{
+		"webhooks":       {"state": "ready", "state_message": "Printer is ready"},
+		"print_stats":    {"state": state, "filename": status.File, "message": ""},
+		"display_status": {"progress": status.Progress, "message": nil},
+		"virtual_sdcard": {"progress": status.Progress, "is_active": state == "printing", "file_path": status.File},
+	}
+	for i, t := range status.Nozzles {
+		name := "extruder"
+		if i > 0 {
+			name += string(rune('0' + i))
+		}
+		objects[name] = map[string]any{"temperature": t.Actual, "target": t.Target, "power": 0}
+	}
+	if status.Bed != nil {
+		objects["heater_bed"] = map[string]any{"temperature": status.Bed.Actual, "target": status.Bed.Target, "power": 0}
+	}
+	return objects
+}
+
+func moonrakerResult(w http.ResponseWriter, status int, result any) {
+	writeJSON(w, status, map[string]any{"result": result})
+}
+
+func moonrakerError(w http.ResponseWriter, status int, message string) {
+	requestLog(w).Warn("Moonraker error", "status", status, "message", message)
+	writeJSON(w, status, map[string]any{
+		"error": map[string]any{"code": status, "message": message, "traceback": ""},
+	})
+}
@@ -2,28 +2,29 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"log"
-	"net"
+	"log/slog"
+	"math/rand/v2"
+	"mime/multipart"
 	"net/http"
-	"path/filepath"
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	maxMemory = 64 << 20 // 64MB
+	maxMemory         = 64 << 20 // 64MB
+	octoPrintMaxField = 4 << 10  // form fields other than the file
+
+	octoPrintAPIVersion    = "0.1"
+	octoPrintServerVersion = "1.2.3"
 )
 
 var (
-	fixShutoff        = true
-	fixPreheat        = true
-	// fixReinforceTower = true
-	fixReplaceTool    = true
-
 	// userAgent: OrcaSlicer/01.09.03.50
 	// userAgent: BBL-Slicer/v01.09.03.50 (dark) Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko)
 	// userAgent: PrusaSlicer/2.6.0+arm64 (3.10.2-202402201133)
@@ -31,7 +32,10 @@ var (
 	reUserAgent = regexp.MustCompile(`^(\w+)/(\S+)(?:[+-].*)?$`)
 )
 
+// stats are shared by the servers, the dashboard and watch-dir, which update
+// them from their own goroutines.
 type stats struct {
+	mu          sync.Mutex
 	start       time.Time
 	memory      uint64
 	success     uint
@@ -47,6 +51,8 @@ type last struct {
 }
 
 func (s *stats) addSuccess(filaname string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.success++
 	s.lastSuccess = &last{
 		filaname: normalizedFilename(filaname),
@@ -56,6 +62,8 @@ func (s *stats) addSuccess(filaname string, size int64) {
 }
 
 func (s *stats) addFailure(filaname string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.failure++
 	s.lastFailure = &last{
 		filaname: normalizedFilename(filaname),
@@ -67,6 +75,8 @@ func (s *stats) addFailure(filaname string, size int64) {
 func (s *stats) String() string {
 	var mem runtime.MemStats
 	runtime.ReadMemStats(&mem)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.memory = mem.Alloc
 
 	buf := bytes.Buffer{}
@@ -78,150 +88,251 @@ func (s *stats) String() string {
 	return buf.String()
 }
 
-func LoggingMiddleware(next http.Handler) http.Handler {
+// loggedResponse records the status of a response and carries the logger
+// of its request.
+type loggedResponse struct {
+	http.ResponseWriter
+	status int
+	log    *slog.Logger
+}
+
+func (w *loggedResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggedResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *loggedResponse) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *loggedResponse) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// requestLog returns the logger of the request that w answers.
+func requestLog(w http.ResponseWriter) *slog.Logger {
+	if lw, ok := w.(*loggedResponse); ok {
+		return lw.log
+	}
+	return slog.Default()
+}
+
+// LoggingMiddleware logs every request with an ID, the X-Request-Id of the
+// client or a new one, that is sent back in X-Request-Id. The ID is in the
+// context of the request, the uploads log it too.
+func LoggingMiddleware(next http.Handler, logger *slog.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 64 {
+			id = fmt.Sprintf("%08x", rand.Uint32())
+		}
+		w.Header().Set("X-Request-Id", id)
+		lw := &loggedResponse{ResponseWriter: w, log: logger.With("request", id)}
+
 		start := time.Now()
 		defer func() {
-			log.Printf("Request %s %s completed in %v", r.Method, r.URL.Path, time.Since(start))
+			lw.log.Info("Request completed", "method", r.Method, "path", r.URL.Path, "status", lw.status, "duration", time.Since(start))
 		}()
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(lw, r.WithContext(context.WithValue(r.Context(), requestIDCtx{}, id)))
 	})
 }
 
-func startOctoPrintServer(listenAddr string, printer *Printer) error {
-	var (
-		_stats *stats
-		mux    = http.NewServeMux()
-	)
-
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		protocol := "HTTP"
-		if printer.Sacp {
-			protocol = "SACP"
-		} else if printer.Moonraker {
-			protocol = "Moonraker"
-		}
+type requestIDCtx struct{}
+
+// requestID returns the ID of the request of ctx, "" if there is none.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDCtx{}).(string)
+	return id
+}
+
+func startOctoPrintServer(listenAddr string, b *bridge) error {
+	mux := http.NewServeMux()
+
+	registerDashboard(mux, b)
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		printer := b.target(r)
 		resp := `sm2uploader ` + Version + ` - https://github.com/macdylan/sm2uploader` + "\n\n" +
 			`	printer id: ` + printer.ID + "\n" +
 			`	printer ip: ` + printer.IP + "\n" +
-			`	protocol: ` + protocol + "\n\n" +
-			_stats.String()
+			`	protocol: ` + printer.Protocol() + "\n\n" +
+			b.stats.String()
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		writeResponse(w, http.StatusOK, resp)
 	})
 
 	mux.HandleFunc("/api/version", func(w http.ResponseWriter, r *http.Request) {
-		respVersion := `{"api": "0.1", "server": "1.2.3", "text": "OctoPrint 1.2.3/Dummy"}`
+		respVersion := `{"api": "` + octoPrintAPIVersion + `", "server": "` + octoPrintServerVersion + `", "text": "OctoPrint ` + octoPrintServerVersion + `/Dummy"}`
 		writeResponse(w, http.StatusOK, respVersion)
 	})
 
+	mux.HandleFunc("GET /api/files", b.files.handleList)
+	mux.HandleFunc("GET /api/files/local/{path...}", b.files.handleFile)
 	mux.HandleFunc("/api/files/local", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			b.files.handleList(w, r)
+			return
+		}
 		// Check if request is a POST request
 		if r.Method != http.MethodPost {
 			methodNotAllowedResponse(w, r.Method)
 			return
 		}
 
-		err := r.ParseMultipartForm(maxMemory)
-		if err != nil {
-			internalServerErrorResponse(w, err.Error())
-			return
-		}
-
-		// Retrieve the uploaded file
-		file, fd, err := r.FormFile("file")
+		// The form is read as a stream, so the printer receives the file while
+		// the slicer is still sending it. The size is unknown until the file
+		// part is read.
+		mr, err := r.MultipartReader()
 		if err != nil {
 			bedRequestResponse(w, err.Error())
 			return
 		}
-		defer file.Close()
 
-		// read X-Api-Key header
-		apiKey := r.Header.Get("X-Api-Key")
-		apiKey = testUserAgent(r.Header.Get("User-Agent"), apiKey)
-		if len(apiKey) > 5 {
-			argumentsFromApi(apiKey)
+		printer := b.target(r)
+		if !b.allowed(w, r, printer) {
+			return
 		}
+		apiKey := b.smfixSwitches(r)
+
+		form := &octoPrintForm{mr: mr, fields: map[string]string{}}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				bedRequestResponse(w, "no file in request")
+				return
+			} else if err != nil {
+				bedRequestResponse(w, err.Error())
+				return
+			}
 
-		// Send the stream to the printer
-		payload := NewPayload(file, fd.Filename, fd.Size)
+			if part.FormName() != "file" {
+				if err := form.readField(part); err != nil {
+					bedRequestResponse(w, err.Error())
+					return
+				}
+				continue
+			}
 
-		// Moonraker/Klipper devices don't need G-Code fix
-		moonrakerNoFix := printer.Moonraker
-		effectiveNoFix := NoFix || moonrakerNoFix
-		if moonrakerNoFix && !NoFix {
-			log.Printf("Moonraker device detected, skipping G-Code fix for '%s'", payload.Name)
+			// Send the stream to the printer
+			form.part = part
+			form.payload = NewPayload(form, part.FileName(), 0)
+			form.payload.sizeUnknown = true
+			form.log = requestLog(w)
+			form.apply()
+			if err := b.upload(r.Context(), printer, form.payload, apiKey); err != nil {
+				internalServerErrorResponse(w, err.Error())
+				return
+			}
+			break
 		}
 
-		// If output directory is specified and the file needs fixing,
-		// pre-process it and save both original and fixed files to disk.
-		if OutputDir != "" && payload.ShouldBeFix() && !effectiveNoFix {
-			origContent, readErr := io.ReadAll(file)
-			if readErr != nil {
-				log.Printf("Warning: failed to read '%s' for output: %s", payload.Name, readErr)
-			} else {
-				fixedContent, procErr := postProcess(bytes.NewReader(origContent))
-				if procErr != nil {
-					log.Printf("Warning: failed to post-process '%s' for output: %s", payload.Name, procErr)
-				} else {
-					fixedPath, saveErr := saveToOutputDir(payload.Name, bytes.NewReader(origContent), fixedContent, true)
-					if saveErr != nil {
-						log.Printf("Warning: failed to save to output dir: %s", saveErr)
-					} else if fixedPath != "" {
-						payload.FixedFile = fixedPath
-						payload.Size = int64(len(fixedContent))
-						log.Printf("Saved: original -> %s/%s, fixed -> %s/%s_fixed%s",
-							OutputDir, payload.Name, OutputDir, payload.Name[:len(payload.Name)-len(filepath.Ext(payload.Name))], filepath.Ext(payload.Name))
-					}
-				}
-			}
-		} else if OutputDir != "" {
-			log.Printf("Skipping output save for '%s' (shouldFix=%v, nofix=%v)",
-				payload.Name, payload.ShouldBeFix(), effectiveNoFix)
+		// Return success response, with the analysis of the file
+		resp := map[string]any{"done": true}
+		if f := b.files.get(form.payload.Name); f != nil {
+			resp["files"] = map[string]any{"local": f}
 		}
+		writeJSON(w, http.StatusOK, resp)
+	})
 
-		if err := Connector.Upload(printer, payload); err != nil {
-			_stats.addFailure(payload.Name, payload.Size)
-			internalServerErrorResponse(w, err.Error())
+	logOctoPrint.Info("Starting OctoPrint server", "addr", listenAddr)
+	if MDNSAnnounce {
+		if shutdown, err := announceOctoPrint(listenAddr, b); err != nil {
+			logOctoPrint.Warn("Not announced via mDNS", "err", err)
+		} else {
+			atExit(shutdown)
+		}
+	}
+	// the API of every known printer is served under /printers/<id>/ too,
+	// the mDNS registration of the printer points there
+	root := http.NewServeMux()
+	root.Handle("/", mux)
+	root.HandleFunc("/printers/{id}/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		p := b.lookup(r.PathValue("id"))
+		if p == nil {
+			notFoundResponse(w, "printer not found")
 			return
 		}
+		u := *r.URL
+		u.Path, u.RawPath = "/"+r.PathValue("path"), ""
+		r = r.WithContext(context.WithValue(r.Context(), printerCtx{}, p))
+		r.URL = &u
+		mux.ServeHTTP(w, r)
+	})
 
-		_stats.addSuccess(payload.Name, payload.Size)
-
-		log.Printf("Upload finished: %s [%s]", fd.Filename, payload.ReadableSize())
+	// everything but the dashboard page needs an API key, the page asks for it
+	protected := http.NewServeMux()
+	protected.Handle("/", b.requireAPIKey(root))
+	protected.Handle("GET /{$}", mux)
+	return b.serve(listenAddr, protected, logOctoPrint)
+}
 
-		// Return success response
-		writeResponse(w, http.StatusOK, `{"done": true}`)
-	})
+// octoPrintForm streams the file part of an OctoPrint upload form. The
+// fields sent after the file are read when the file part is drained, before
+// Read returns io.EOF, so "print" is known when the transfer has finished.
+// The size of the file is known then too, Read checks the limits the
+// connector could not check before the transfer.
+type octoPrintForm struct {
+	mr      *multipart.Reader
+	part    *multipart.Part
+	payload *Payload
+	fields  map[string]string
+	read    int64
+	log     *slog.Logger
+}
 
-	handler := LoggingMiddleware(mux)
-	log.Printf("Starting OctoPrint server on %s ...", listenAddr)
+func (f *octoPrintForm) Read(p []byte) (int, error) {
+	n, err := f.part.Read(p)
+	f.read += int64(n)
+	if f.read > FILE_SIZE_MAX || err == io.EOF {
+		f.payload.Size, f.payload.sizeUnknown = f.read, false
+		if err := f.payload.checkSize(); err != nil {
+			return n, err
+		}
+	}
+	if err == io.EOF {
+		for {
+			part, err := f.mr.NextPart()
+			if err != nil {
+				break
+			}
+			if f.readField(part) != nil {
+				break
+			}
+		}
+		f.apply()
+	}
+	return n, err
+}
 
-	// Create a listener
-	listener, err := net.Listen("tcp", listenAddr)
+func (f *octoPrintForm) readField(part *multipart.Part) error {
+	defer part.Close()
+	b, err := io.ReadAll(io.LimitReader(part, octoPrintMaxField))
 	if err != nil {
 		return err
 	}
+	f.fields[part.FormName()] = string(b)
+	return nil
+}
 
-	_stats = &stats{
-		start:   time.Now(),
-		success: 0,
-		failure: 0,
-		lastSuccess: &last{
-			filaname: "",
-			size:     0,
-			time:     time.Now(),
-		},
-		lastFailure: &last{
-			filaname: "",
-			size:     0,
-			time:     time.Now(),
-		},
+// apply maps the OctoPrint form fields onto the payload. "select" is
+// implied, the printers always select the last uploaded file. "print" can
+// only turn printing on, the profile of the printer may have done it already.
+func (f *octoPrintForm) apply() {
+	f.payload.Print = f.payload.Print || f.fields["print"] == "true"
+	if p := f.fields["path"]; p != "" {
+		f.log.Debug("OctoPrint path ignored", "path", p, "file", f.payload.Name)
 	}
-
-	log.Printf("Server started, now you can upload files to http://%s", listener.Addr().String())
-	// Start the server
-	return http.Serve(listener, handler)
 }
 
 func writeResponse(w http.ResponseWriter, status int, body string) {
@@ -233,60 +344,20 @@ func writeResponse(w http.ResponseWriter, status int, body string) {
 }
 
 func methodNotAllowedResponse(w http.ResponseWriter, method string) {
-	log.Print("Method not allowed: ", method)
+	requestLog(w).Warn("Method not allowed", "method", method)
 	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 }
 
 func internalServerErrorResponse(w http.ResponseWriter, err string) {
-	log.Print("Internal server error: ", err)
+	requestLog(w).Error("Internal server error", "err", err)
 	http.Error(w, err, http.StatusInternalServerError)
 }
 
 func bedRequestResponse(w http.ResponseWriter, err string) {
-	log.Print("Bad request: ", err)
+	requestLog(w).Warn("Bad request", "err", err)
 	http.Error(w, err, http.StatusBadRequest)
 }
 
-func argumentsFromApi(str string) {
-	if strings.TrimSpace(str) == "" {
-		return
-	}
-	if strings.Contains(str, "nofix") {
-		NoFix = true
-		log.Printf("SMFix disabled via API key (nofix)")
-		return
-	}
-	fixPreheat = !strings.Contains(str, "nopreheat")
-	fixShutoff = !strings.Contains(str, "noshutoff")
-	// fixReinforceTower = !strings.Contains(str, "noreinforcetower")
-	fixReplaceTool = !strings.Contains(str, "noreplacetool")
-
-	msg := []string{}
-	if fixPreheat {
-		msg = append(msg, "-preheat")
-	} else {
-		msg = append(msg, "-nopreheat")
-	}
-	if fixShutoff {
-		msg = append(msg, "-shutoff")
-	} else {
-		msg = append(msg, "-noshutoff")
-	}
-	// if fixReinforceTower {
-	// 	msg = append(msg, "-reinforcetower")
-	// } else {
-	// 	msg = append(msg, "-noreinforcetower")
-	// }
-	if fixReplaceTool {
-		msg = append(msg, "-replacetool")
-	} else {
-		msg = append(msg, "-noreplacetool")
-	}
-	if len(msg) > 0 {
-		log.Printf("SMFix with args: %s", strings.Join(msg, " "))
-	}
-}
-
 func testUserAgent(userAgent, apiKey string) string {
 	matches := reUserAgent.FindStringSubmatch(userAgent)
 	if len(matches) >= 2 {
@@ -298,11 +369,11 @@ func testUserAgent(userAgent, apiKey string) string {
 			} else {
 				apiKey += ";nopreheat;"
 			}
-		// if !strings.Contains(apiKey, "noreinforcetower") && strings.Contains(apiKey, "reinforceTower") {
-		// 	apiKey = strings.Replace(apiKey, "reinforceTower", "noreinforcetower", -1)
-		// } else {
-		// 	apiKey += ";noreinforcetower;"
-		// }
+			// if !strings.Contains(apiKey, "noreinforcetower") && strings.Contains(apiKey, "reinforceTower") {
+			// 	apiKey = strings.Replace(apiKey, "reinforceTower", "noreinforcetower", -1)
+			// } else {
+			// 	apiKey += ";noreinforcetower;"
+			// }
 		}
 	}
 	return apiKey
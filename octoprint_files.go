@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// octoPrintFile is a file of the OctoPrint files API.
+type octoPrintFile struct {
+	Name          string             `json:"name"`
+	Display       string             `json:"display"`
+	Path          string             `json:"path"`
+	Type          string             `json:"type"`
+	TypePath      []string           `json:"typePath"`
+	Origin        string             `json:"origin"`
+	Size          int64              `json:"size"`
+	Date          int64              `json:"date"`
+	Refs          map[string]string  `json:"refs"`
+	GcodeAnalysis *octoPrintAnalysis `json:"gcodeAnalysis,omitempty"`
+}
+
+type octoPrintAnalysis struct {
+	EstimatedPrintTime float64                      `json:"estimatedPrintTime"` // s
+	Filament           map[string]octoPrintFilament `json:"filament"`           // by tool0, tool1...
+	Dimensions         map[string]float64           `json:"dimensions"`
+	PrintingArea       map[string]float64           `json:"printingArea"`
+}
+
+type octoPrintFilament struct {
+	Length float64 `json:"length"` // mm
+	Volume float64 `json:"volume"` // cm³
+}
+
+// newOctoPrintAnalysis returns the analysis of s in the format of OctoPrint.
+func newOctoPrintAnalysis(s *gcodeStats) *octoPrintAnalysis {
+	a := &octoPrintAnalysis{
+		EstimatedPrintTime: s.Time,
+		Filament:           map[string]octoPrintFilament{},
+		Dimensions: map[string]float64{
+			"width":  s.Max[0] - s.Min[0],
+			"depth":  s.Max[1] - s.Min[1],
+			"height": s.Max[2] - s.Min[2],
+		},
+		PrintingArea: map[string]float64{
+			"minX": s.Min[0], "minY": s.Min[1], "minZ": s.Min[2],
+			"maxX": s.Max[0], "maxY": s.Max[1], "maxZ": s.Max[2],
+		},
+	}
+	for _, t := range s.Tools {
+		volume, _ := s.filament(t)
+		a.Filament[fmt.Sprintf("tool%d", t)] = octoPrintFilament{Length: s.Extrusion[t], Volume: volume}
+	}
+	return a
+}
+
+// octoPrintFiles are the files uploaded through the bridge, newest last.
+// Slicers and OctoPrint clients read the analysis from the file list.
+type octoPrintFiles struct {
+	mu    sync.Mutex
+	files []*octoPrintFile
+}
+
+// add records the uploaded payload, it replaces a file of the same name.
+func (l *octoPrintFiles) add(p *Payload) *octoPrintFile {
+	f := &octoPrintFile{
+		Name:     p.Name,
+		Display:  p.Name,
+		Path:     p.Name,
+		Type:     "machinecode",
+		TypePath: []string{"machinecode", "gcode"},
+		Origin:   "local",
+		Size:     p.Size,
+		Date:     time.Now().Unix(),
+		Refs:     map[string]string{"resource": "/api/files/local/" + p.Name},
+	}
+	if p.analysis != nil {
+		f.GcodeAnalysis = newOctoPrintAnalysis(p.analysis)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.files = slices.DeleteFunc(l.files, func(old *octoPrintFile) bool { return old.Name == f.Name })
+	l.files = append(l.files, f)
+	if len(l.files) > uploadHistorySize {
+		l.files = l.files[len(l.files)-uploadHistorySize:]
+	}
+	return f
+}
+
+func (l *octoPrintFiles) list() []*octoPrintFile {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.files)
+}
+
+func (l *octoPrintFiles) get(name string) *octoPrintFile {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, f := range l.files {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// handleList answers GET /api/files and /api/files/local with the files
+// uploaded since the start.
+func (l *octoPrintFiles) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"files": l.list(), "free": 0})
+}
+
+// handleFile answers GET /api/files/local/{path}.
+func (l *octoPrintFiles) handleFile(w http.ResponseWriter, r *http.Request) {
+	f := l.get(r.PathValue("path"))
+	if f == nil {
+		notFoundResponse(w, "file not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
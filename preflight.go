@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Force uploads files that do not fit the printer, see preflight.
+var Force bool
+
+var errPreflightFailed = errors.New("preflight check failed")
+
+// coordinates may exceed the work area by this much, slicers round
+const preflightTolerance = 0.5 // mm
+
+// envelope is the work area and the limits of a machine with a module.
+type envelope struct {
+	X, Y, Z float64 // mm
+	Nozzle  float64 // max nozzle temperature (°C), 0 if there is no nozzle
+	Bed     float64 // max bed temperature (°C)
+	Tools   int     // nozzles, 0 for laser and CNC
+}
+
+/*
+machineEnvelopes by model and module. Modules are 3dp, dual (the dual
+extrusion module of the A-series), laser and cnc. 3D printing coordinates
+start at the front left corner, laser and CNC coordinates are relative to
+the work origin, so only their size is checked.
+*/
+var machineEnvelopes = map[string]map[string]envelope{
+	"A150": {
+		"3dp":   {X: 160, Y: 160, Z: 145, Nozzle: 275, Bed: 80, Tools: 1},
+		"laser": {X: 160, Y: 160, Z: 145},
+		"cnc":   {X: 160, Y: 160, Z: 90},
+	},
+	"A250": {
+		"3dp":   {X: 230, Y: 250, Z: 235, Nozzle: 275, Bed: 100, Tools: 1},
+		"dual":  {X: 230, Y: 235, Z: 235, Nozzle: 300, Bed: 100, Tools: 2},
+		"laser": {X: 230, Y: 250, Z: 235},
+		"cnc":   {X: 230, Y: 250, Z: 180},
+	},
+	"A350": {
+		"3dp":   {X: 320, Y: 350, Z: 330, Nozzle: 275, Bed: 100, Tools: 1},
+		"dual":  {X: 310, Y: 350, Z: 330, Nozzle: 300, Bed: 100, Tools: 2},
+		"laser": {X: 320, Y: 350, Z: 330},
+		"cnc":   {X: 320, Y: 350, Z: 275},
+	},
+	"Artisan": {
+		"3dp":   {X: 400, Y: 400, Z: 400, Nozzle: 300, Bed: 110, Tools: 2},
+		"laser": {X: 400, Y: 400, Z: 400},
+		"cnc":   {X: 400, Y: 400, Z: 400},
+	},
+	"J1": {
+		"3dp": {X: 300, Y: 200, Z: 200, Nozzle: 300, Bed: 100, Tools: 2},
+	},
+	"U1": {
+		"3dp": {X: 270, Y: 270, Z: 270, Nozzle: 300, Bed: 100, Tools: 4},
+	},
+}
+
+// machineModel returns the key of machineEnvelopes for a printer model,
+// e.g. "A350" for "Snapmaker 2.0 A350", or "" if it is unknown.
+func machineModel(model string) string {
+	model = strings.ToUpper(model)
+	for _, m := range []struct{ key, name string }{
+		{"A150", "A150"}, {"A250", "A250"}, {"A350", "A350"},
+		{"A400", "Artisan"}, {"ARTISAN", "Artisan"}, {"J1", "J1"}, {"U1", "U1"},
+	} {
+		if strings.Contains(model, m.key) {
+			return m.name
+		}
+	}
+	return ""
+}
+
+// check returns the problems of the file on model, and the module it needs.
+func (s *gcodeStats) check(model string) (module string, problems []string) {
+	modules, ok := machineEnvelopes[model]
+	if !ok {
+		return s.Module, []string{fmt.Sprintf("unknown model '%s'", model)}
+	}
+	module = s.Module
+	if _, ok := modules["dual"]; ok && module == "3dp" && (s.dual || len(s.Tools) > 1) {
+		module = "dual"
+	}
+	env, ok := modules[module]
+	if !ok {
+		return module, []string{fmt.Sprintf("the %s has no %s module", model, module)}
+	}
+
+	size := [3]float64{env.X, env.Y, env.Z}
+	for i, axis := range []string{"X", "Y", "Z"} {
+		if !s.known[i] {
+			continue
+		}
+		lo, hi := s.Min[i], s.Max[i]
+		if env.Tools == 0 {
+			// laser and CNC: relative to the work origin
+			if hi-lo > size[i]+preflightTolerance {
+				problems = append(problems, fmt.Sprintf("%s size %.1f mm exceeds %.0f mm", axis, hi-lo, size[i]))
+			}
+		} else if lo < -preflightTolerance || hi > size[i]+preflightTolerance {
+			problems = append(problems, fmt.Sprintf("%s %.1f..%.1f mm exceeds 0..%.0f mm", axis, lo, hi, size[i]))
+		}
+	}
+	for _, t := range slices.Sorted(maps.Keys(s.Nozzle)) {
+		if env.Nozzle > 0 && s.Nozzle[t] > env.Nozzle {
+			problems = append(problems, fmt.Sprintf("T%d temperature %.0f°C exceeds %.0f°C", t, s.Nozzle[t], env.Nozzle))
+		}
+	}
+	if env.Bed > 0 && s.Bed > env.Bed {
+		problems = append(problems, fmt.Sprintf("bed temperature %.0f°C exceeds %.0f°C", s.Bed, env.Bed))
+	}
+	if env.Tools > 0 {
+		for _, t := range s.Tools {
+			if t >= env.Tools {
+				problems = append(problems, fmt.Sprintf("T%d is used, the %s has %d tool(s)", t, model, env.Tools))
+			}
+		}
+	}
+	return module, problems
+}
+
+/*
+analyzePayload analyzes the file of p and leaves it to be read from where
+it was. ok is false if the file can not seek, like the body of an upload;
+streams are analyzed while they are sent, see analyzeWhileSending. The stats
+are nil if the file can not be analyzed, err is an error of reading the
+file.
+*/
+func analyzePayload(p *Payload, model string) (s *gcodeStats, ok bool, err error) {
+	rs, ok := p.File.(io.ReadSeeker)
+	if !ok {
+		return nil, false, nil
+	}
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, false, nil
+	}
+	s, aerr := analyzeGcode(rs, p.Name, model)
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return nil, true, err
+	}
+	if aerr != nil {
+		p.log(logPreflight).Warn("Can not analyze, not checked", "file", p.Name, "err", aerr)
+		return nil, true, nil
+	}
+	return s, true, nil
+}
+
+// preflight checks the file of p against the envelope of the printer. It
+// refuses the upload if the file does not fit, with -force it only warns.
+// Printers of unknown models are not checked. The analysis is kept in p.
+// A stream is not refused, it is checked after it is sent, see checkSent.
+func preflight(printer *Printer, p *Payload) error {
+	if !isGcodeFile(p.Name) {
+		return nil
+	}
+	model := machineModel(printer.Model)
+	if model == "" {
+		p.log(logPreflight).Debug("Unknown model, not checked", "printer", printerKey(printer), "model", printer.Model)
+		return nil
+	}
+
+	s, ok, err := analyzePayload(p, model)
+	if !ok {
+		p.log(logPreflight).Debug("Stream, checked after sending", "file", p.Name)
+		return nil
+	}
+	if err != nil || s == nil {
+		return err
+	}
+	p.analysis = s
+	module, problems := s.check(model)
+	if len(problems) == 0 {
+		p.log(logPreflight).Info("Preflight passed", "file", p.Name, "model", model, "module", module)
+		return nil
+	}
+	if Force {
+		for _, problem := range problems {
+			p.log(logPreflight).Warn("Ignored (-force): "+problem, "file", p.Name, "model", model, "module", module)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s does not fit the %s (%s): %s, use -force to upload anyway",
+		errPreflightFailed, p.Name, model, module, strings.Join(problems, "; "))
+}
+
+// checkSent logs the problems of a file that was sent without preflight,
+// the analysis made while sending it is in p.
+func checkSent(printer *Printer, p *Payload) {
+	model := machineModel(printer.Model)
+	if p.analysis == nil || model == "" {
+		return
+	}
+	module, problems := p.analysis.check(model)
+	for _, problem := range problems {
+		p.log(logPreflight).Warn("Sent, but "+problem, "file", p.Name, "model", model, "module", module)
+	}
+}
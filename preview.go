@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+)
+
+// previewMargin is the space around the toolpath, in parts of the size
+const previewMargin = 0.05
+
+// colors of the lowest and the highest layer, laser and CNC use the first
+var (
+	previewBottom = color.NRGBA{0x9a, 0x42, 0x00, 0xff}
+	previewTop    = color.NRGBA{0xff, 0xb0, 0x50, 0xff}
+)
+
+var errNothingToDraw = errors.New("no moves to draw")
+
+/*
+renderPreview draws the toolpath of the G-code in data seen from the top, as
+a PNG of width x height with a transparent background. The moves of the
+bounding box are drawn, so 3D printing shows the extrusions only. Higher
+layers are lighter and cover the lower ones.
+*/
+func renderPreview(data []byte, name, model string, width, height int) ([]byte, error) {
+	s, err := analyzeGcode(bytes.NewReader(data), name, model)
+	if err != nil {
+		return nil, err
+	}
+	if !s.known[0] || !s.known[1] {
+		return nil, errNothingToDraw
+	}
+
+	// fit the bounding box, Y points up
+	w, h := max(s.Max[0]-s.Min[0], 1), max(s.Max[1]-s.Min[1], 1)
+	scale := min(float64(width)/w, float64(height)/h) * (1 - 2*previewMargin)
+	offX := (float64(width) - w*scale) / 2
+	offY := (float64(height) - h*scale) / 2
+	point := func(p [3]float64) (int, int) {
+		x := offX + (p[0]-s.Min[0])*scale
+		y := float64(height) - offY - (p[1]-s.Min[1])*scale
+		return int(math.Round(x)), int(math.Round(y))
+	}
+	shade := func(z float64) color.NRGBA {
+		if s.Module != "3dp" || s.Max[2] <= s.Min[2] {
+			return previewBottom
+		}
+		t := (z - s.Min[2]) / (s.Max[2] - s.Min[2])
+		mix := func(a, b uint8) uint8 { return uint8(float64(a) + (float64(b)-float64(a))*t) }
+		return color.NRGBA{mix(previewBottom.R, previewTop.R), mix(previewBottom.G, previewTop.G), mix(previewBottom.B, previewTop.B), 0xff}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	_, err = scanGcode(bytes.NewReader(data), name, model, func(from, to [3]float64) {
+		x0, y0 := point(from)
+		x1, y1 := point(to)
+		drawLine(img, x0, y0, x1, y1, shade(to[2]))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// drawLine draws a line from x0,y0 to x1,y1 (Bresenham).
+func drawLine(img *image.NRGBA, x0, y0, x1, y1 int, c color.NRGBA) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		img.SetNRGBA(x0, y0, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -7,12 +7,24 @@ import (
 )
 
 type Printer struct {
-	IP        string `yaml:"ip"`
-	ID        string `yaml:"id"`
-	Model     string `yaml:"model"`
-	Token     string `yaml:"token"`
-	Sacp      bool   `yaml:"sacp"`
-	Moonraker bool   `yaml:"moonraker"` // new device using Moonraker API protocol
+	IP        string   `yaml:"ip"`
+	ID        string   `yaml:"id"`
+	Model     string   `yaml:"model"`
+	Token     string   `yaml:"token"`
+	Sacp      bool     `yaml:"sacp"`
+	Moonraker bool     `yaml:"moonraker"` // new device using Moonraker API protocol
+	Alias     string   `yaml:"alias,omitempty"`
+	Profile   *Profile `yaml:"profile,omitempty"`
+
+	// from the mDNS SRV/TXT/A/AAAA records
+	Hostname  string            `yaml:"hostname,omitempty"`
+	Port      int               `yaml:"port,omitempty"`
+	Addresses []string          `yaml:"-"`
+	TXT       map[string]string `yaml:"-"`
+
+	// from the last discovery, not saved
+	Status string `yaml:"-"` // "status:" of the UDP answer, e.g. IDLE
+	Method string `yaml:"-"` // udp, mdns or scan
 }
 
 /*
@@ -25,12 +37,18 @@ func NewPrinter(resp []byte) (*Printer, error) {
 		return nil, errors.New("invalid response")
 	}
 	var (
-		parts = strings.Split(msg, "|")
-		id    = parts[0][:strings.LastIndex(parts[0], "@")]
-		ip    = parts[0][strings.LastIndex(parts[0], "@")+1:]
-		model = parts[1][strings.Index(parts[1], ":")+1:]
-		sacp  = strings.Contains(msg, "SACP:1")
+		parts  = strings.Split(msg, "|")
+		id     = parts[0][:strings.LastIndex(parts[0], "@")]
+		ip     = parts[0][strings.LastIndex(parts[0], "@")+1:]
+		model  = parts[1][strings.Index(parts[1], ":")+1:]
+		sacp   = strings.Contains(msg, "SACP:1")
+		status string
 	)
+	for _, part := range parts[2:] {
+		if v, ok := strings.CutPrefix(part, "status:"); ok {
+			status = v
+		}
+	}
 
 	return &Printer{
 		IP:        ip,
@@ -39,9 +57,29 @@ func NewPrinter(resp []byte) (*Printer, error) {
 		Token:     "",
 		Sacp:      sacp,
 		Moonraker: false,
+		Status:    status,
+		Method:    "udp",
 	}, nil
 }
 
+// Protocol returns the name of the protocol used to talk to the printer.
+func (p *Printer) Protocol() string {
+	if p.Sacp {
+		return "SACP"
+	} else if p.Moonraker {
+		return "Moonraker"
+	}
+	return "HTTP"
+}
+
+// printerKey identifies a printer in the dashboard API and progress events.
+func printerKey(p *Printer) string {
+	if p.ID != "" {
+		return p.ID
+	}
+	return p.IP
+}
+
 /* Name for promptui */
 func (p *Printer) String() string {
 	return fmt.Sprintf("%s@%s - %s", p.ID, p.IP, p.Model)
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+)
+
+/*
+Profile holds the defaults of a printer in hosts.yaml, fields that are not
+set keep the built-in defaults:
+
+	printers:
+	  - id: J1V19
+	    ip: 192.168.1.19
+	    profile:
+	      tool1: 210
+	      bed: 60
+	      fix_shutoff: false
+	      output: /srv/gcode
+	      protocol: sacp
+
+A command line flag or its environment variable wins over the profile, the
+profile wins over the config file.
+*/
+type Profile struct {
+	Tool1          *int    `yaml:"tool1,omitempty"`
+	Tool2          *int    `yaml:"tool2,omitempty"`
+	Bed            *int    `yaml:"bed,omitempty"`
+	Home           *bool   `yaml:"home,omitempty"`
+	NoFix          *bool   `yaml:"nofix,omitempty"`
+	FixPreheat     *bool   `yaml:"fix_preheat,omitempty"`
+	FixShutoff     *bool   `yaml:"fix_shutoff,omitempty"`
+	FixReplaceTool *bool   `yaml:"fix_replacetool,omitempty"`
+	FixOrcaUnload  *bool   `yaml:"fix_orcaunload,omitempty"`
+	Print          *bool   `yaml:"print,omitempty"` // start printing after upload
+	Output         *string `yaml:"output,omitempty"`
+	Protocol       string  `yaml:"protocol,omitempty"` // sacp, http or moonraker
+}
+
+// uploadSettings are the settings of an upload to a printer. Every upload
+// has its own, so the uploads of the servers do not share the profiles.
+type uploadSettings struct {
+	tool1, tool2, bed int
+	home, nofix       bool
+	fix               FixOptions
+	print             bool
+	output            string
+}
+
+// baseSettings are the settings before any profile is applied.
+var baseSettings uploadSettings
+
+// saveBaseSettings must be called after loadConfig.
+func saveBaseSettings() {
+	baseSettings = uploadSettings{
+		tool1: Tool1Temperature, tool2: Tool2Temperature, bed: BedTemperature,
+		home: Home, nofix: NoFix, fix: SmFixOptions,
+		print:  PrintAfterUpload,
+		output: OutputDir,
+	}
+}
+
+// preheating reports whether the printer is heated or homed before the upload.
+func (s uploadSettings) preheating() bool {
+	return s.tool1 != 0 || s.tool2 != 0 || s.bed != 0 || s.home
+}
+
+// fixOptions returns the SMFix options of the upload.
+func (s uploadSettings) fixOptions() FixOptions {
+	o := s.fix
+	o.NoFix = s.nofix
+	return o
+}
+
+// applyProfile returns the settings of an upload to p, the base settings
+// with the profile of p applied. Settings given by a flag or an environment
+// variable are kept.
+func applyProfile(p *Printer) uploadSettings {
+	s := baseSettings
+	if p == nil || p.Profile == nil {
+		return s
+	}
+	pr := p.Profile
+	fromProfile(&s.tool1, pr.Tool1, "tool1")
+	fromProfile(&s.tool2, pr.Tool2, "tool2")
+	fromProfile(&s.bed, pr.Bed, "bed")
+	fromProfile(&s.home, pr.Home, "home")
+	fromProfile(&s.nofix, pr.NoFix, "nofix")
+	fromProfile(&s.fix.Preheat, pr.FixPreheat, "smfix.preheat")
+	fromProfile(&s.fix.Shutoff, pr.FixShutoff, "smfix.shutoff")
+	fromProfile(&s.fix.ReplaceTool, pr.FixReplaceTool, "smfix.replacetool")
+	fromProfile(&s.fix.OrcaUnload, pr.FixOrcaUnload, "smfix.orcaunload")
+	fromProfile(&s.print, pr.Print, "print")
+	fromProfile(&s.output, pr.Output, "output")
+
+	slog.Debug("Profile", "printer", printerKey(p), "tool1", s.tool1, "tool2", s.tool2, "bed", s.bed,
+		"home", s.home, "nofix", s.nofix, "fix", s.fix,
+		"print", s.print, "output", s.output, "protocol", p.Protocol())
+	return s
+}
+
+// applyProfileProtocol switches p to the protocol of its profile, the known
+// hosts call it when they are read.
+func applyProfileProtocol(p *Printer) {
+	if p.Profile == nil {
+		return
+	}
+	switch strings.ToLower(p.Profile.Protocol) {
+	case "":
+	case "sacp":
+		p.Sacp, p.Moonraker = true, false
+	case "http":
+		p.Sacp, p.Moonraker = false, false
+	case "moonraker":
+		p.Sacp, p.Moonraker = false, true
+	default:
+		slog.Warn("Unknown protocol in the profile", "protocol", p.Profile.Protocol, "printer", printerKey(p))
+	}
+}
+
+// fromProfile sets dst to the profile value unless the setting was given by
+// a flag or an environment variable.
+func fromProfile[T any](dst *T, value *T, key string) {
+	if value == nil {
+		return
+	}
+	if src, ok := configSources[key]; ok && src.Source != "default" && src.Source != "config" {
+		return
+	}
+	*dst = *value
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	eventsKeepAlive = 15 * time.Second
+)
+
+type ProgressPhase string
+
+const (
+	PhaseFixing      ProgressPhase = "fixing"
+	PhaseConnecting  ProgressPhase = "connecting"
+	PhaseAuthorizing ProgressPhase = "authorizing" // waiting for "Yes" on the touchscreen
+	PhaseUploading   ProgressPhase = "uploading"
+	PhaseVerifying   ProgressPhase = "verifying" // all bytes sent, waiting for the printer
+	PhaseDone        ProgressPhase = "done"
+	PhaseFailed      ProgressPhase = "failed"
+)
+
+// ProgressEvent describes the state of an upload. Upload is 0 for events
+// that belong to a printer rather than a file, e.g. authorizing a preheat.
+type ProgressEvent struct {
+	Upload   int64         `json:"upload"`
+	File     string        `json:"file,omitempty"`
+	Printer  string        `json:"printer"`
+	Protocol string        `json:"protocol,omitempty"`
+	Phase    ProgressPhase `json:"phase"`
+	Sent     int64         `json:"sent"`
+	Total    int64         `json:"total"`
+	Chunk    int           `json:"chunk,omitempty"`  // 1-based, SACP only
+	Chunks   int           `json:"chunks,omitempty"` // SACP only
+	Error    string        `json:"error,omitempty"`
+	Time     time.Time     `json:"time"`
+}
+
+// progressBus fans out progress events of all connectors to subscribers.
+type progressBus struct {
+	mu   sync.Mutex
+	subs map[chan ProgressEvent]empty
+}
+
+var (
+	Progress = &progressBus{subs: map[chan ProgressEvent]empty{}}
+
+	uploadSeq atomic.Int64
+)
+
+// Publish sends e to all subscribers. Events are dropped for subscribers
+// that can not keep up, so a slow client never stalls a transfer.
+func (b *progressBus) Publish(e ProgressEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			if e.Phase != PhaseUploading {
+				slog.Debug("Progress event dropped, subscriber is full", "upload", e.Upload, "phase", e.Phase)
+			}
+		}
+	}
+}
+
+// Subscribe returns a channel of events and a function to stop receiving them.
+func (b *progressBus) Subscribe() (<-chan ProgressEvent, func()) {
+	ch := make(chan ProgressEvent, 256)
+	b.mu.Lock()
+	b.subs[ch] = empty{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+	}
+}
+
+// publishPrinter sends an event that is not related to a single upload.
+func publishPrinter(p *Printer, phase ProgressPhase) {
+	Progress.Publish(ProgressEvent{
+		Printer:  printerKey(p),
+		Protocol: p.Protocol(),
+		Phase:    phase,
+	})
+}
+
+// handleProgressEvents streams the progress events as Server-Sent Events,
+// each event is sent as "event: progress" with a JSON ProgressEvent. With
+// the background discovery running, PrinterEvents are sent as "event: printer".
+func handleProgressEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		internalServerErrorResponse(w, "streaming unsupported")
+		return
+	}
+
+	ch, cancel := Progress.Subscribe()
+	defer cancel()
+
+	var printerCh <-chan PrinterEvent // nil blocks forever
+	if Registry != nil {
+		var cancel func()
+		printerCh, cancel = Registry.Subscribe()
+		defer cancel()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-ch:
+			b, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: progress\ndata: %s\n\n", b)
+		case e := <-printerCh:
+			b, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: printer\ndata: %s\n\n", b)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
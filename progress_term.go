@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	progressWidth    = 79 // the line must not wrap, it is redrawn with \r
+	progressInterval = 100 * time.Millisecond
+)
+
+// renderProgress draws the uploads in progress on the last line of t, it
+// returns a function that stops drawing and clears the line.
+func renderProgress(t *terminal) (stop func()) {
+	ch, cancel := Progress.Subscribe()
+	done := make(chan empty)
+	finished := make(chan empty)
+	go func() {
+		defer close(finished)
+		active := map[string]ProgressEvent{}
+		var drawn time.Time
+		for {
+			select {
+			case e := <-ch:
+				key := "printer " + e.Printer
+				if e.Upload != 0 {
+					key = fmt.Sprintf("upload %d", e.Upload)
+					delete(active, "printer "+e.Printer) // authorized
+				}
+				if e.Phase == PhaseDone || e.Phase == PhaseFailed {
+					delete(active, key)
+				} else {
+					active[key] = e
+				}
+				if e.Phase == PhaseUploading && time.Since(drawn) < progressInterval {
+					continue
+				}
+				t.setProgress(progressLine(active))
+				drawn = time.Now()
+			case <-done:
+				t.setProgress("")
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		close(done)
+		<-finished
+	}
+}
+
+// progressLine describes the events, oldest upload first:
+//
+//	a.gcode > J1V19 uploading 45.2% (12.1 MiB) | A350 tap Yes on the touchscreen
+func progressLine(active map[string]ProgressEvent) string {
+	events := make([]ProgressEvent, 0, len(active))
+	for _, e := range active {
+		events = append(events, e)
+	}
+	slices.SortFunc(events, func(a, b ProgressEvent) int { return int(a.Upload - b.Upload) })
+
+	parts := make([]string, 0, len(events))
+	for _, e := range events {
+		var s strings.Builder
+		if e.File != "" {
+			s.WriteString(e.File + " > ")
+		}
+		s.WriteString(e.Printer + " ")
+		switch e.Phase {
+		case PhaseAuthorizing:
+			s.WriteString("tap Yes on the touchscreen")
+		case PhaseUploading:
+			if e.Total > 0 {
+				fmt.Fprintf(&s, "uploading %.1f%% (%s)", float64(e.Sent)/float64(e.Total)*100, humanReadableSize(e.Total))
+			} else {
+				fmt.Fprintf(&s, "uploading %s", humanReadableSize(e.Sent))
+			}
+		default:
+			s.WriteString(string(e.Phase))
+		}
+		parts = append(parts, s.String())
+	}
+
+	line := strings.Join(parts, " | ")
+	if r := []rune(line); len(r) > progressWidth {
+		line = string(r[:progressWidth-3]) + "..."
+	}
+	return line
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PrusaLink emulation for the PrusaSlicer "PrusaLink" host type, files are
+// sent with PUT /api/v1/files/<storage>/<path> and streamed to the printer.
+
+const (
+	prusaLinkRealm    = "Printer API"
+	prusaLinkStorage  = "usb"
+	digestNonceMaxAge = 5 * time.Minute
+)
+
+var (
+	PrusaLinkUser     string
+	PrusaLinkPassword string
+)
+
+func startPrusaLinkServer(listenAddr string, b *bridge) error {
+	var (
+		printer = b.printer
+		mux     = http.NewServeMux()
+	)
+
+	mux.HandleFunc("GET /api/version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"api":             "2.0.0",
+			"server":          "2.1.2",
+			"text":            "PrusaLink",
+			"hostname":        printerKey(printer),
+			"nozzle_diameter": 0.4,
+			"capabilities":    map[string]bool{"upload-by-put": true},
+		})
+	})
+
+	mux.HandleFunc("GET /api/v1/info", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"name":               printerKey(printer),
+			"hostname":           printerKey(printer),
+			"serial":             printer.ID,
+			"nozzle_diameter":    0.4,
+			"min_extrusion_temp": 170,
+			"sd_ready":           false,
+		})
+	})
+
+	mux.HandleFunc("GET /api/v1/storage", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"storage_list": []map[string]any{
+				{"path": "/" + prusaLinkStorage, "name": prusaLinkStorage, "type": "USB", "read_only": false, "available": true},
+			},
+		})
+	})
+
+	mux.HandleFunc("GET /api/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		status, err := Connector.Status(printer)
+		state := "IDLE"
+		if err == errConnectorBusy {
+			state = "BUSY"
+		} else if err == errStatusNotSupported {
+			// the printer accepts uploads, the slicer must not wait for it
+			state = "IDLE"
+		} else if err != nil {
+			state = "ERROR"
+		} else {
+			state = prusaLinkState(status.State)
+		}
+
+		st := map[string]any{"state": state}
+		if status != nil {
+			if len(status.Nozzles) > 0 {
+				st["temp_nozzle"] = status.Nozzles[0].Actual
+				st["target_nozzle"] = status.Nozzles[0].Target
+			}
+			if status.Bed != nil {
+				st["temp_bed"] = status.Bed.Actual
+				st["target_bed"] = status.Bed.Target
+			}
+		}
+		resp := map[string]any{
+			"storage": map[string]any{"path": "/" + prusaLinkStorage, "name": prusaLinkStorage, "read_only": false},
+			"printer": st,
+		}
+		if status != nil && status.File != "" {
+			resp["job"] = map[string]any{"progress": status.Progress * 100, "file": status.File}
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	mux.HandleFunc("PUT /api/v1/files/{storage}/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("storage") != prusaLinkStorage {
+			notFoundResponse(w, "storage not found")
+			return
+		}
+		name := path.Base(r.PathValue("path"))
+		if name == "." || name == "/" {
+			bedRequestResponse(w, "no file name")
+			return
+		}
+		if r.ContentLength < 0 {
+			http.Error(w, "Length Required", http.StatusLengthRequired)
+			return
+		}
+
+		if !b.allowed(w, r, printer) {
+			return
+		}
+		// the same SMFix switches as the OctoPrint API
+		apiKey := b.smfixSwitches(r)
+
+		// stream the request body, it is not spooled by net/http
+		payload := NewPayload(r.Body, name, r.ContentLength)
+		payload.Print = structuredBool(r.Header.Get("Print-After-Upload"))
+		if err := b.upload(r.Context(), printer, payload, apiKey); err != nil {
+			internalServerErrorResponse(w, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	// PrusaSlicer sends either the digest credentials or the API key
+	handler := b.requireAPIKey(mux)
+	if PrusaLinkPassword != "" {
+		handler = b.digestOrAPIKey(newDigestAuth(prusaLinkRealm, PrusaLinkUser, PrusaLinkPassword), mux)
+	}
+
+	logPrusaLink.Info("Starting PrusaLink server", "addr", listenAddr)
+	return b.serve(listenAddr, handler, logPrusaLink)
+}
+
+// prusaLinkState maps the printer state to the PrusaLink printer states.
+func prusaLinkState(state string) string {
+	switch strings.ToUpper(state) {
+	case "RUNNING", "PRINTING":
+		return "PRINTING"
+	case "PAUSED", "PAUSING":
+		return "PAUSED"
+	case "STOPPED", "CANCELLED":
+		return "STOPPED"
+	case "COMPLETE", "COMPLETED":
+		return "FINISHED"
+	case "ERROR":
+		return "ERROR"
+	}
+	return "IDLE"
+}
+
+// structuredBool parses a HTTP structured field boolean ("?1"), plain
+// booleans are accepted as well.
+func structuredBool(s string) bool {
+	if s == "?1" {
+		return true
+	}
+	v, _ := strconv.ParseBool(s)
+	return v
+}
+
+// digestAuth implements HTTP digest access authentication (RFC 2617, MD5)
+// as used by PrusaLink. Nonces are signed timestamps, no state is kept.
+type digestAuth struct {
+	realm    string
+	user     string
+	password string
+	secret   []byte
+}
+
+func newDigestAuth(realm, user, password string) *digestAuth {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &digestAuth{realm: realm, user: user, password: password, secret: secret}
+}
+
+func (d *digestAuth) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !d.verify(r) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s", qop="auth", nonce="%s", algorithm=MD5`, d.realm, d.nonce()))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// digestOrAPIKey lets a request pass with the digest credentials or with one
+// of the API keys, a key keeps its printer restrictions. Without API keys the
+// X-Api-Key only carries SMFix switches and the digest is required.
+func (b *bridge) digestOrAPIKey(d *digestAuth, next http.Handler) http.Handler {
+	keyed, digest := b.requireAPIKey(next), d.wrap(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(b.keys) > 0 && (r.Header.Get("X-Api-Key") != "" || r.URL.Query().Get("apikey") != "") {
+			keyed.ServeHTTP(w, r)
+			return
+		}
+		digest.ServeHTTP(w, r)
+	})
+}
+
+func (d *digestAuth) nonce() string {
+	ts := strconv.FormatInt(time.Now().Unix(), 16)
+	return ts + "-" + d.sign(ts)
+}
+
+func (d *digestAuth) sign(ts string) string {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte(ts))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func (d *digestAuth) validNonce(nonce string) bool {
+	ts, sig, ok := strings.Cut(nonce, "-")
+	if !ok || !hmac.Equal([]byte(sig), []byte(d.sign(ts))) {
+		return false
+	}
+	sec, err := strconv.ParseInt(ts, 16, 64)
+	return err == nil && time.Since(time.Unix(sec, 0)) < digestNonceMaxAge
+}
+
+func (d *digestAuth) verify(r *http.Request) bool {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Digest ")
+	if !ok {
+		return false
+	}
+	params := parseDigestParams(auth)
+	if params["username"] != d.user || params["realm"] != d.realm || params["uri"] != r.URL.RequestURI() || !d.validNonce(params["nonce"]) {
+		return false
+	}
+
+	ha1 := md5hex(d.user + ":" + d.realm + ":" + d.password)
+	ha2 := md5hex(r.Method + ":" + params["uri"])
+	var expected string
+	if qop := params["qop"]; qop != "" {
+		expected = md5hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], qop, ha2}, ":"))
+	} else {
+		expected = md5hex(ha1 + ":" + params["nonce"] + ":" + ha2)
+	}
+	return hmac.Equal([]byte(expected), []byte(params["response"]))
+}
+
+// parseDigestParams parses the comma separated key=value pairs of a Digest
+// Authorization header, values may be quoted.
+func parseDigestParams(s string) map[string]string {
+	params := map[string]string{}
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, s = rest[1:end+1], rest[end+2:]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+		}
+		params[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return params
+}
+
+func md5hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// a printer is offline after missing this many discovery rounds
+	registryMissedRounds = 3
+	// wait before listening for mDNS again if the socket can not be opened
+	registrySnifferRetry = 30 * time.Second
+)
+
+type PrinterEventType string
+
+const (
+	PrinterAppeared    PrinterEventType = "appeared"
+	PrinterDisappeared PrinterEventType = "disappeared"
+	PrinterMoved       PrinterEventType = "moved" // new IP address
+)
+
+// PrinterEvent is sent when a printer goes online or offline, or when it
+// answers from a new address.
+type PrinterEvent struct {
+	Type    PrinterEventType `json:"type"`
+	Printer string           `json:"printer"`
+	IP      string           `json:"ip"`
+	OldIP   string           `json:"old_ip,omitempty"`
+	Model   string           `json:"model,omitempty"`
+	Time    time.Time        `json:"time"`
+}
+
+type printerState struct {
+	lastSeen time.Time
+	online   bool
+}
+
+// printerRegistry keeps discovering printers in the background. Known hosts
+// are updated in place, so a printer that got a new IP address from DHCP is
+// reachable without a restart.
+type printerRegistry struct {
+	ls       *LocalStorage
+	interval time.Duration
+
+	mu     sync.Mutex
+	states map[string]*printerState // by printer id
+	subs   map[chan PrinterEvent]empty
+}
+
+// Registry is nil unless the background discovery is running.
+var Registry *printerRegistry
+
+func newPrinterRegistry(ls *LocalStorage, interval time.Duration) *printerRegistry {
+	return &printerRegistry{
+		ls:       ls,
+		interval: interval,
+		states:   map[string]*printerState{},
+		subs:     map[chan PrinterEvent]empty{},
+	}
+}
+
+// run discovers printers every interval until ctx is done, mDNS answers are
+// sniffed all the time.
+func (r *printerRegistry) run(ctx context.Context) {
+	go r.sniff(ctx)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, DiscoverTimeout)
+		go probeZeroconf(probeCtx)
+		for _, p := range discoverBroadcast(DiscoverTimeout) {
+			r.seen(p)
+		}
+		cancel()
+		r.expire()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *printerRegistry) sniff(ctx context.Context) {
+	for ctx.Err() == nil {
+		for p := range sniffer(ctx) {
+			r.seen(p)
+		}
+		// the sniffer stops if the multicast socket fails
+		select {
+		case <-time.After(registrySnifferRetry):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// seen records an answer of p, new printers and new addresses are saved
+// to the known hosts.
+func (r *printerRegistry) seen(p *Printer) {
+	if p.ID == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := false
+	if known := r.ls.Get(p.ID); known == nil {
+		r.ls.Add(p)
+		changed = true
+	} else if known.IP != p.IP {
+		oldIP := known.IP
+		r.ls.Add(p)
+		changed = true
+		logDiscovery.Info("Printer moved", "printer", p.ID, "from", oldIP, "to", p.IP)
+		r.publish(PrinterEvent{Type: PrinterMoved, Printer: p.ID, IP: p.IP, OldIP: oldIP, Model: known.Model})
+	}
+
+	st, ok := r.states[p.ID]
+	if !ok {
+		st = &printerState{}
+		r.states[p.ID] = st
+	}
+	st.lastSeen = time.Now()
+	if !st.online {
+		st.online = true
+		logDiscovery.Debug("Printer online", "printer", p.String())
+		r.publish(PrinterEvent{Type: PrinterAppeared, Printer: p.ID, IP: p.IP, Model: p.Model})
+	}
+
+	if changed {
+		if err := r.ls.Save(); err != nil {
+			logDiscovery.Error("Error saving known hosts", "err", err)
+		}
+	}
+}
+
+// expire marks the printers that stopped answering as offline.
+func (r *printerRegistry) expire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, st := range r.states {
+		if st.online && time.Since(st.lastSeen) > registryMissedRounds*r.interval {
+			st.online = false
+			e := PrinterEvent{Type: PrinterDisappeared, Printer: id}
+			if p := r.ls.Get(id); p != nil {
+				e.IP, e.Model = p.IP, p.Model
+			}
+			logDiscovery.Debug("Printer offline", "printer", id)
+			r.publish(e)
+		}
+	}
+}
+
+// State returns when p was seen last and if it is online, a zero time if
+// it has not been seen since the start.
+func (r *printerRegistry) State(p *Printer) (lastSeen time.Time, online bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if st, ok := r.states[p.ID]; ok {
+		return st.lastSeen, st.online
+	}
+	return time.Time{}, false
+}
+
+// publish must be called with r.mu held, slow subscribers miss events.
+func (r *printerRegistry) publish(e PrinterEvent) {
+	e.Time = time.Now()
+	for ch := range r.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of events and a function to stop receiving them.
+func (r *printerRegistry) Subscribe() (<-chan PrinterEvent, func()) {
+	ch := make(chan PrinterEvent, 64)
+	r.mu.Lock()
+	r.subs[ch] = empty{}
+	r.mu.Unlock()
+	return ch, func() {
+		r.mu.Lock()
+		delete(r.subs, ch)
+		r.mu.Unlock()
+	}
+}
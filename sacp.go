@@ -10,7 +10,6 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
-	"log"
 	"net"
 	"time"
 )
@@ -148,7 +147,7 @@ func writeLE[T any](w io.Writer, u T) {
 }
 
 func SACP_connect(ip string, timeout time.Duration) (net.Conn, error) {
-	conn, err := net.Dial("tcp4", ip+":8888")
+	conn, err := net.Dial("tcp", net.JoinHostPort(ip, SACPPort))
 	if err != nil {
 		// log.Printf("Error connecting to %s: %v", ip, err)
 		return nil, err
@@ -183,18 +182,14 @@ func SACP_connect(ip string, timeout time.Duration) (net.Conn, error) {
 			return nil, err
 		}
 
-		if Debug {
-			log.Printf("-- SACP_connect got:\n%v", p)
-		}
+		logSACP.Debug("SACP_connect got", "packet", p)
 
 		if p.CommandSet == 1 && p.CommandID == 5 {
 			break
 		}
 	}
 
-	if Debug {
-		log.Println("-- Connected to printer")
-	}
+	logSACP.Debug("Connected to printer", "ip", ip)
 
 	return conn, nil
 }
@@ -286,9 +281,7 @@ func SACP_send_command(conn net.Conn, command_set uint8, command_id uint8, data
 		return err
 	}
 
-	if Debug {
-		log.Printf("-- Sequence: %d Sent GCode: %x", sequence, data.Bytes())
-	}
+	logSACP.Debug("Sent GCode", "sequence", sequence, "data", hex.EncodeToString(data.Bytes()))
 
 	for {
 		conn.SetReadDeadline(time.Now().Add(timeout))
@@ -297,9 +290,7 @@ func SACP_send_command(conn net.Conn, command_set uint8, command_id uint8, data
 			return err
 		}
 
-		if Debug {
-			log.Printf("-- Got reply from printer: %v", p)
-		}
+		logSACP.Debug("Got reply from printer", "packet", p)
 
 		if p.Sequence == sequence && p.CommandSet == command_set && p.CommandID == command_id {
 			if len(p.Data) == 1 && p.Data[0] == 0 {
@@ -309,14 +300,39 @@ func SACP_send_command(conn net.Conn, command_set uint8, command_id uint8, data
 	}
 }
 
+// SACP_start_screen_print starts printing a file that was uploaded to the
+// touchscreen, the file is identified by name and md5 (same as Luban).
+func SACP_start_screen_print(conn net.Conn, head_type uint8, filename string, md5hash string, timeout time.Duration) error {
+	data := bytes.Buffer{}
+	data.WriteByte(head_type)
+	writeSACPstring(&data, filename)
+	writeSACPstring(&data, md5hash)
+
+	return SACP_send_command(conn, 0xb0, 0x08, data, timeout)
+}
+
+func SACP_pause_print(conn net.Conn, timeout time.Duration) error {
+	return SACP_send_command(conn, 0xac, 0x04, bytes.Buffer{}, timeout)
+}
+
+func SACP_resume_print(conn net.Conn, timeout time.Duration) error {
+	return SACP_send_command(conn, 0xac, 0x05, bytes.Buffer{}, timeout)
+}
+
+func SACP_stop_print(conn net.Conn, timeout time.Duration) error {
+	return SACP_send_command(conn, 0xac, 0x06, bytes.Buffer{}, timeout)
+}
+
 func SACP_start_upload(conn net.Conn, filename string, gcode []byte, timeout time.Duration) error {
-	return SACP_start_upload_reader(conn, filename, bytes.NewReader(gcode), int64(len(gcode)), timeout)
+	return SACP_start_upload_reader(conn, filename, bytes.NewReader(gcode), int64(len(gcode)), timeout, nil)
 }
 
 // SACP_start_upload_reader streams file content from an io.Reader instead of
 // holding the entire file in memory. It computes the MD5 hash incrementally
 // and reads chunks on demand as the printer requests them.
-func SACP_start_upload_reader(conn net.Conn, filename string, reader io.Reader, size int64, timeout time.Duration) error {
+// onProgress is optional and called after each chunk with the bytes sent
+// and the 1-based chunk number.
+func SACP_start_upload_reader(conn net.Conn, filename string, reader io.Reader, size int64, timeout time.Duration, onProgress func(sent, total int64, chunk, chunks int)) error {
 	// Compute MD5 incrementally and buffer all content for random access
 	// (SACP protocol requests chunks non-sequentially, so we need a buffer)
 	h := md5.New()
@@ -326,8 +342,8 @@ func SACP_start_upload_reader(conn net.Conn, filename string, reader io.Reader,
 	if err != nil {
 		return err
 	}
-	if int64(len(gcode)) != size {
-		log.Printf("Warning: file size mismatch: expected %d, got %d", size, len(gcode))
+	if size > 0 && int64(len(gcode)) != size {
+		logSACP.Warn("File size mismatch", "expected", size, "got", len(gcode))
 	}
 	md5hash := h.Sum(nil)
 
@@ -341,9 +357,7 @@ func SACP_start_upload_reader(conn net.Conn, filename string, reader io.Reader,
 	writeLE(&data, package_count)
 	writeSACPstring(&data, hex.EncodeToString(md5hash[:]))
 
-	if Debug {
-		log.Println("-- Starting upload ...")
-	}
+	logSACP.Debug("Starting upload", "file", filename, "packages", package_count)
 
 	conn.SetWriteDeadline(time.Now().Add(timeout))
 	_, err = conn.Write(SACP_pack{
@@ -372,9 +386,7 @@ func SACP_start_upload_reader(conn net.Conn, filename string, reader io.Reader,
 			return errInvalidSize
 		}
 
-		if Debug {
-			log.Printf("-- Got reply from printer: %v", p)
-		}
+		logSACP.Debug("Got reply from printer", "packet", p)
 
 		switch {
 		case p.CommandSet == 0xb0 && p.CommandID == 0:
@@ -404,9 +416,9 @@ func SACP_start_upload_reader(conn net.Conn, filename string, reader io.Reader,
 			writeLE(&data, pkgRequested)
 			writeSACPbytes(&data, pkgData)
 
-			// log.Printf("  sending package %d of %d", pkgRequested+1, package_count)
-			perc := float64(pkgRequested+1) / float64(package_count) * 100.0
-			log.Printf("  - SACP sending %.1f%%", perc)
+			if onProgress != nil {
+				onProgress(int64(SACP_data_len*int(pkgRequested)+len(pkgData)), int64(len(gcode)), int(pkgRequested)+1, int(package_count))
+			}
 
 			conn.SetWriteDeadline(time.Now().Add(timeout))
 			_, err := conn.Write(SACP_pack{
@@ -427,9 +439,7 @@ func SACP_start_upload_reader(conn net.Conn, filename string, reader io.Reader,
 			// send finished!!!
 			if len(p.Data) == 1 && p.Data[0] == 0 {
 
-				if Debug {
-					log.Print("-- Upload finished")
-				}
+				logSACP.Debug("Upload finished", "file", filename)
 
 				if err := SACP_disconnect(conn, timeout); err != nil {
 					return err
@@ -438,7 +448,7 @@ func SACP_start_upload_reader(conn net.Conn, filename string, reader io.Reader,
 				return nil // everything is ok!
 			}
 
-			log.Print("Unable to process b0/02 with invalid data", p.Data)
+			logSACP.Warn("Unable to process b0/02 with invalid data", "data", hex.EncodeToString(p.Data))
 
 		default:
 			continue
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scanParallelism  = 64
+	scanProbeTimeout = 1 * time.Second
+	scanMaxHosts     = 4096 // a /20
+	scanLocalPrefix  = 24   // larger local subnets are scanned around our address
+)
+
+var ScanCIDRs string
+
+// Scan probes every address of the subnets with the UDP discover message
+// (unicast, port 20054) and on the SACP/HTTP/Moonraker ports, for networks
+// that drop broadcast and multicast.
+func Scan(cidrs []string, timeout time.Duration) ([]*Printer, error) {
+	var ips []net.IP
+	for _, cidr := range cidrs {
+		hosts, err := subnetHosts(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		logDiscovery.Info("Scanning", "cidr", cidr, "addresses", len(hosts))
+		ips = append(ips, hosts...)
+	}
+	if len(ips) > scanMaxHosts {
+		return nil, fmt.Errorf("too many addresses to scan: %d, max %d", len(ips), scanMaxHosts)
+	}
+
+	if timeout > scanProbeTimeout {
+		timeout = scanProbeTimeout
+	}
+
+	var (
+		mu       sync.Mutex
+		printers []*Printer
+		wg       sync.WaitGroup
+		queue    = make(chan net.IP)
+	)
+	for range scanParallelism {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range queue {
+				if p := scanHost(ip.String(), timeout); p != nil {
+					p.Method = "scan"
+					logDiscovery.Debug("Scan found", "printer", p.String(), "protocol", p.Protocol())
+					mu.Lock()
+					printers = append(printers, p)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, ip := range ips {
+		queue <- ip
+	}
+	close(queue)
+	wg.Wait()
+
+	return printers, nil
+}
+
+// scanHost probes ip on all ports at once and fingerprints the responder,
+// nil if it does not look like a printer.
+func scanHost(ip string, timeout time.Duration) *Printer {
+	var (
+		wg      sync.WaitGroup
+		answer  *Printer
+		open    = map[string]bool{}
+		mu      sync.Mutex
+		tcpPort = []string{SACPPort, HTTPPort, MoonrakerPort}
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		answer = probeUDP(ip, timeout)
+	}()
+	for _, port := range tcpPort {
+		wg.Add(1)
+		go func(port string) {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, port), timeout)
+			if err != nil {
+				return
+			}
+			conn.Close()
+			mu.Lock()
+			open[port] = true
+			mu.Unlock()
+		}(port)
+	}
+	wg.Wait()
+
+	// the UDP answer has the id and the model
+	if answer != nil {
+		return answer
+	}
+
+	switch {
+	case open[MoonrakerPort] && isMoonraker(ip, timeout):
+		p := &Printer{IP: ip, ID: ip, Moonraker: true}
+		if hostname := moonrakerHostname(ip, timeout); hostname != "" {
+			p.ID = hostname
+		}
+		return p
+	case open[SACPPort] && isSACP(ip, timeout):
+		return &Printer{IP: ip, ID: ip, Sacp: true}
+	case open[HTTPPort] && isSnapmakerHTTP(ip, timeout):
+		return &Printer{IP: ip, ID: ip}
+	}
+	return nil
+}
+
+// probeUDP sends the discover message to ip only.
+func probeUDP(ip string, timeout time.Duration) *Printer {
+	conn, err := net.Dial("udp4", net.JoinHostPort(ip, "20054"))
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte("discover")); err != nil {
+		return nil
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil
+	}
+	p, err := NewPrinter(buf[:n])
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+func scanGet(url string, timeout time.Duration, v any) (*http.Response, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		err = json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp, err
+}
+
+func isMoonraker(ip string, timeout time.Duration) bool {
+	var info struct {
+		Result struct {
+			KlippyState string `json:"klippy_state"`
+		} `json:"result"`
+	}
+	_, err := scanGet("http://"+urlHost(ip, MoonrakerPort)+"/server/info", timeout, &info)
+	return err == nil && info.Result.KlippyState != ""
+}
+
+func moonrakerHostname(ip string, timeout time.Duration) string {
+	var info struct {
+		Result struct {
+			Hostname string `json:"hostname"`
+		} `json:"result"`
+	}
+	scanGet("http://"+urlHost(ip, MoonrakerPort)+"/printer/info", timeout, &info)
+	return info.Result.Hostname
+}
+
+// isSACP says hello like SACP_connect does, other services on port 8888 do
+// not answer it.
+func isSACP(ip string, timeout time.Duration) bool {
+	conn, err := SACP_connect(ip, timeout)
+	if err != nil || conn == nil {
+		return false
+	}
+	SACP_disconnect(conn, timeout)
+	conn.Close()
+	return true
+}
+
+/*
+isSnapmakerHTTP checks for the Snapmaker 2 API, unlike /connect the status
+request never asks for approval on the touchscreen. Without a token the API
+refuses the request, but not with a HTML error page like other web servers;
+with one it answers the status object or 204 while waiting for approval.
+*/
+func isSnapmakerHTTP(ip string, timeout time.Duration) bool {
+	var status struct {
+		Status string `json:"status"`
+	}
+	resp, err := scanGet("http://"+urlHost(ip, HTTPPort)+"/api/v1/status", timeout, &status)
+	if resp == nil {
+		return false
+	}
+	html := strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html")
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return err == nil && status.Status != ""
+	case http.StatusNoContent:
+		return true
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return !html
+	}
+	return false
+}
+
+// subnetHosts returns the host addresses of an IPv4 CIDR, without the
+// network and broadcast addresses.
+func subnetHosts(cidr string) ([]net.IP, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	base := ipnet.IP.To4()
+	if base == nil {
+		return nil, fmt.Errorf("%s: only IPv4 subnets can be scanned", cidr)
+	}
+	ones, bits := ipnet.Mask.Size()
+	if 1<<(bits-ones) > scanMaxHosts {
+		return nil, fmt.Errorf("%s: subnet too large to scan, max %d addresses", cidr, scanMaxHosts)
+	}
+
+	first := binary.BigEndian.Uint32(base)
+	size := uint32(1) << (bits - ones)
+	var ips []net.IP
+	for i := uint32(0); i < size; i++ {
+		if size > 2 && (i == 0 || i == size-1) {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, first+i)
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// localSubnets returns the IPv4 subnets of the network interfaces, at most
+// a /24 around each local address.
+func localSubnets() []string {
+	var subnets []string
+	seen := map[string]bool{}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return subnets
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		mask := ipnet.Mask
+		if ones, _ := mask.Size(); ones < scanLocalPrefix {
+			mask = net.CIDRMask(scanLocalPrefix, 32)
+		}
+		subnet := (&net.IPNet{IP: ipnet.IP.Mask(mask), Mask: mask}).String()
+		if !seen[subnet] {
+			seen[subnet] = true
+			subnets = append(subnets, subnet)
+		}
+	}
+	return subnets
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/macdylan/SMFix/fix"
+)
+
+/*
+FixOptions selects the SMFix stages run on a G-code file. Every payload has
+its own, made from -fix (or the config), the profile of the printer and the
+switches of the API key, so a request does not change the next one.
+*/
+type FixOptions struct {
+	NoFix          bool // upload the file as it is, -nofix
+	Preheat        bool
+	Shutoff        bool
+	ReplaceTool    bool
+	OrcaUnload     bool
+	ReinforceTower bool
+}
+
+// SmFixOptions are the stages of -fix, before the profile and the API key.
+var SmFixOptions = FixOptions{Preheat: true, Shutoff: true, ReplaceTool: true, OrcaUnload: true}
+
+// fixStage is a step of SMFix.
+type fixStage struct {
+	name string
+	fn   fix.GcodeModifier
+}
+
+// fixStages are the stages by name, in the order they run. SMFix has the
+// reinforcetower stage disabled for now, it has no function.
+var fixStages = []fixStage{
+	{"shutoff", fix.GcodeFixShutoff},
+	{"preheat", fix.GcodeFixPreheat},
+	{"replacetool", fix.GcodeReplaceToolNum},
+	{"reinforcetower", nil},
+	{"orcaunload", fix.GcodeFixOrcaToolUnload},
+}
+
+// fixFlag defines -fix in fs, its default is $FIX.
+func fixFlag(fs *flag.FlagSet) {
+	if env, ok := os.LookupEnv("FIX"); ok {
+		if o, err := parseFixOptions(env); err == nil {
+			SmFixOptions = o
+		}
+	}
+	fs.Var(&SmFixOptions, "fix", "SMFix `stages` to run, comma separated: "+fixStageNames())
+}
+
+// stage returns the switch of the stage name, nil if there is none.
+func (o *FixOptions) stage(name string) *bool {
+	switch name {
+	case "preheat":
+		return &o.Preheat
+	case "shutoff":
+		return &o.Shutoff
+	case "replacetool":
+		return &o.ReplaceTool
+	case "orcaunload":
+		return &o.OrcaUnload
+	case "reinforcetower":
+		return &o.ReinforceTower
+	}
+	return nil
+}
+
+// stages returns the enabled stages, the ones that are not available are
+// logged to log.
+func (o FixOptions) stages(log *slog.Logger) []fixStage {
+	stages := []fixStage{}
+	for _, s := range fixStages {
+		switch {
+		case !*o.stage(s.name):
+		case s.fn == nil:
+			log.Warn("SMFix stage not available, skipped", "stage", s.name)
+		default:
+			stages = append(stages, s)
+		}
+	}
+	return stages
+}
+
+/*
+withSwitches returns o with the switches of an API key or of the X-SMFix
+header applied, e.g. "nopreheat;noshutoff" or "nofix". The switches only turn
+off what -fix and the profile turned on.
+*/
+func (o FixOptions) withSwitches(switches string) FixOptions {
+	if strings.Contains(switches, "nofix") {
+		o.NoFix = true
+	}
+	for _, s := range fixStages {
+		if strings.Contains(switches, "no"+s.name) {
+			*o.stage(s.name) = false
+		}
+	}
+	return o
+}
+
+// String returns the enabled stages like -fix takes them.
+func (o FixOptions) String() string {
+	names := []string{}
+	for _, s := range fixStages {
+		if *o.stage(s.name) {
+			names = append(names, s.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Set implements flag.Value, the stages not in the list are turned off.
+func (o *FixOptions) Set(value string) error {
+	v, err := parseFixOptions(value)
+	if err != nil {
+		return err
+	}
+	v.NoFix = o.NoFix
+	*o = v
+	return nil
+}
+
+// Get implements flag.Getter.
+func (o *FixOptions) Get() any {
+	return *o
+}
+
+// parseFixOptions parses a comma separated list of stages, e.g.
+// "preheat,shutoff"; an empty list runs none of them.
+func parseFixOptions(value string) (o FixOptions, err error) {
+	for name := range strings.SplitSeq(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		v := o.stage(name)
+		if v == nil {
+			return o, fmt.Errorf("unknown SMFix stage '%s', use %s", name, fixStageNames())
+		}
+		*v = true
+	}
+	return o, nil
+}
+
+// fixStageNames returns the names of the stages for messages.
+func fixStageNames() string {
+	names := make([]string, len(fixStages))
+	for i, s := range fixStages {
+		names[i] = s.name
+	}
+	return strings.Join(names, ", ")
+}
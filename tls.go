@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	selfSignedCertFile = "sm2uploader.crt"
+	selfSignedKeyFile  = "sm2uploader.key"
+	selfSignedValidFor = 5 * 365 * 24 * time.Hour
+)
+
+var (
+	TLSEnabled bool
+	TLSCert    string
+	TLSKey     string
+)
+
+// loadTLSConfig returns the TLS config of the bridge servers, nil if TLS is
+// disabled. Without -tls-cert/-tls-key a self-signed certificate is created
+// next to the known hosts file and reused on the next start.
+func loadTLSConfig() (*tls.Config, error) {
+	if TLSCert == "" && TLSKey == "" && !TLSEnabled {
+		return nil, nil
+	}
+	if (TLSCert == "") != (TLSKey == "") {
+		return nil, errors.New("both -tls-cert and -tls-key are required")
+	}
+
+	certFile, keyFile := TLSCert, TLSKey
+	if certFile == "" {
+		dir := filepath.Dir(KnownHosts)
+		certFile, keyFile = filepath.Join(dir, selfSignedCertFile), filepath.Join(dir, selfSignedKeyFile)
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			if err := generateSelfSignedCert(certFile, keyFile); err != nil {
+				return nil, err
+			}
+			slog.Info("Generated self-signed certificate", "file", certFile)
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// generateSelfSignedCert writes an ECDSA certificate valid for localhost,
+// the hostname and all local addresses.
+func generateSelfSignedCert(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"sm2uploader"}, CommonName: "sm2uploader"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		tmpl.DNSNames = append(tmpl.DNSNames, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ipnet.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// encrypted tokens in the known hosts start with this prefix
+const tokenPrefix = "enc:v1:"
+
+// tokenKeyPath returns the key file of the known hosts, hosts.key next to
+// hosts.yaml.
+func tokenKeyPath(hostsPath string) string {
+	return strings.TrimSuffix(hostsPath, filepath.Ext(hostsPath)) + ".key"
+}
+
+// loadTokenKey returns the cipher of the tokens, the key is $TOKEN_KEY or
+// the content of the key file. Tokens are not encrypted without a key.
+func loadTokenKey(hostsPath string) (cipher.AEAD, error) {
+	secret := []byte(os.Getenv("TOKEN_KEY"))
+	if len(secret) == 0 {
+		path := tokenKeyPath(hostsPath)
+		st, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if runtime.GOOS != "windows" && st.Mode().Perm()&0077 != 0 {
+			return nil, fmt.Errorf("token key %s is readable by others, chmod 600 %[1]s", path)
+		}
+		if secret, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+		if secret = bytes.TrimSpace(secret); len(secret) == 0 {
+			return nil, fmt.Errorf("token key %s is empty", path)
+		}
+	}
+
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// createTokenKey writes a random key to path, an existing key is kept.
+func createTokenKey(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+}
+
+// tokenCipher encrypts the tokens of the known hosts. An unchanged token
+// keeps its ciphertext, so saving does not rewrite an unchanged file.
+type tokenCipher struct {
+	aead   cipher.AEAD // nil if tokens are saved in plain text
+	sealed map[string]string
+}
+
+func newTokenCipher(aead cipher.AEAD) *tokenCipher {
+	return &tokenCipher{aead: aead, sealed: map[string]string{}}
+}
+
+// open decrypts token, a plain text token is returned as it is.
+func (c *tokenCipher) open(token string) (string, error) {
+	data, ok := strings.CutPrefix(token, tokenPrefix)
+	if !ok {
+		return token, nil
+	}
+	if c.aead == nil {
+		return "", errors.New("token is encrypted, but TOKEN_KEY is not set and the key file does not exist")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil || len(raw) < c.aead.NonceSize() {
+		return "", errors.New("invalid encrypted token")
+	}
+	n := c.aead.NonceSize()
+	plain, err := c.aead.Open(nil, raw[:n], raw[n:], nil)
+	if err != nil {
+		return "", errors.New("token can not be decrypted, wrong key")
+	}
+	c.sealed[string(plain)] = token
+	return string(plain), nil
+}
+
+// seal encrypts token if there is a key.
+func (c *tokenCipher) seal(token string) string {
+	if c.aead == nil || token == "" {
+		return token
+	}
+	if s, ok := c.sealed[token]; ok {
+		return s
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	rand.Read(nonce)
+	s := tokenPrefix + base64.RawURLEncoding.EncodeToString(c.aead.Seal(nonce, nonce, []byte(token), nil))
+	c.sealed[token] = s
+	return s
+}
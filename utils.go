@@ -5,11 +5,14 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/macdylan/SMFix/fix"
@@ -17,6 +20,28 @@ import (
 
 type empty struct{}
 
+var (
+	exitMu    sync.Mutex
+	exitHooks []func()
+)
+
+// atExit registers fn to run when the process is stopped by a signal.
+func atExit(fn func()) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	exitHooks = append(exitHooks, fn)
+}
+
+// runAtExit runs the registered functions in reverse order.
+func runAtExit() {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	for i := len(exitHooks) - 1; i >= 0; i-- {
+		exitHooks[i]()
+	}
+	exitHooks = nil
+}
+
 func humanReadableSize(size int64) string {
 	const unit = 1024
 	if size < unit {
@@ -47,14 +72,32 @@ func postProcessFile(file_path string) (out []byte, err error) {
 }
 */
 
-func postProcess(r io.Reader) (out []byte, err error) {
+// postProcess runs the SMFix stages of opts on the G-code for a printer of
+// model. The Snapmaker header is made from the file if SMFix can not read the
+// settings of the slicer, a preview is added if the slicer embedded none.
+func postProcess(r io.Reader, model string, opts FixOptions, log *slog.Logger) (out []byte, err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return fixGcode(data, model, opts, log, nil)
+}
+
+/*
+fixGcode is postProcess for the G-code in data. If stage is not nil, it is
+called with the lines after every step: "parse" drops the empty lines and
+the zero dwells, then the SMFix stages of opts run, "header" is the result.
+The messages of SMFix go to log.
+*/
+func fixGcode(data []byte, model string, opts FixOptions, log *slog.Logger, stage func(name string, lines []string)) (out []byte, err error) {
 	var (
 		isFixed = false
 		nl      = []byte("\n")
 		headers = [][]byte{}
 		gcodes  = []*fix.GcodeBlock{}
-		sc      = bufio.NewScanner(r)
+		sc      = bufio.NewScanner(bytes.NewReader(data))
 	)
+	sc.Buffer(make([]byte, 64<<10), 16<<20) // the Snapmaker headers have the image on one line
 	for sc.Scan() {
 		line := sc.Text()
 		if !isFixed && strings.HasPrefix(line, "; Postprocessed by smfix") {
@@ -80,30 +123,37 @@ func postProcess(r io.Reader) (out []byte, err error) {
 		return nil, err
 	}
 
-	if !isFixed {
-		funcs := []fix.GcodeModifier{}
-
-		if fixShutoff {
-			funcs = append(funcs, fix.GcodeFixShutoff)
-		}
-		if fixPreheat {
-			funcs = append(funcs, fix.GcodeFixPreheat)
-		}
-		if fixReplaceTool {
-			funcs = append(funcs, fix.GcodeReplaceToolNum)
+	snapshot := func(name string) {
+		if stage != nil {
+			lines := make([]string, len(gcodes))
+			for i, g := range gcodes {
+				lines[i] = g.String()
+			}
+			stage(name, lines)
 		}
-		// if fixReinforceTower {
-		// 	funcs = append(funcs, fix.GcodeReinforceTower)
-		// }
-
-		funcs = append(funcs, fix.GcodeFixOrcaToolUnload)
+	}
+	snapshot("parse")
 
-		for _, fn := range funcs {
-			gcodes = fn(gcodes)
+	if !isFixed {
+		for _, s := range opts.stages(log) {
+			gcodes = s.fn(gcodes)
+			snapshot(s.name)
 		}
 
 		if headers, err = fix.ExtractHeader(gcodes); err != nil {
-			return nil, err
+			h, herr := snapmakerHeader(data, model, len(gcodes), log)
+			if herr != nil {
+				log.Debug("No header", "err", herr)
+				return nil, err
+			}
+			log.Info("Slicer settings not found, header made from the G-code", "err", err)
+			headers = h
+		} else if len(fix.Params.Thumbnail) == 0 {
+			if thumb, err := previewPNG(data, ".gcode", model); err == nil {
+				headers = withThumbnail(headers, thumb)
+			} else {
+				log.Warn("No preview", "err", err)
+			}
 		}
 	}
 
@@ -118,25 +168,28 @@ func postProcess(r io.Reader) (out []byte, err error) {
 		buf.WriteString(gcode.String())
 		buf.Write(nl)
 	}
+	if stage != nil {
+		stage("header", strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n"))
+	}
 	return buf.Bytes(), nil
 }
 
 // saveToOutputDir saves the original file content and/or the processed (fixed) file
-// content to the output directory. It returns the path to the fixed file so it
+// content to the output directory dir. It returns the path to the fixed file so it
 // can be used later for streaming upload.
 // If saveOriginal is false, only the _fixed file is saved.
-func saveToOutputDir(name string, original io.Reader, fixed []byte, saveOriginal bool) (fixedPath string, err error) {
-	if OutputDir == "" {
+func saveToOutputDir(dir string, name string, original io.Reader, fixed []byte, saveOriginal bool) (fixedPath string, err error) {
+	if dir == "" {
 		return "", nil
 	}
 
-	if err := os.MkdirAll(OutputDir, 0755); err != nil {
+	if err := os.MkdirAll(dir, 0755); err != nil {
 		return "", fmt.Errorf("failed to create output directory: %w", err)
 	}
 
 	if saveOriginal {
 		// Save original file
-		origPath := filepath.Join(OutputDir, name)
+		origPath := filepath.Join(dir, name)
 		origFile, err := os.Create(origPath)
 		if err != nil {
 			return "", fmt.Errorf("failed to save original file: %w", err)
@@ -151,7 +204,7 @@ func saveToOutputDir(name string, original io.Reader, fixed []byte, saveOriginal
 	ext := filepath.Ext(name)
 	base := name[:len(name)-len(ext)]
 	fixedName := base + "_fixed" + ext
-	fixedPath = filepath.Join(OutputDir, fixedName)
+	fixedPath = filepath.Join(dir, fixedName)
 	if err := os.WriteFile(fixedPath, fixed, 0644); err != nil {
 		return "", fmt.Errorf("failed to save fixed file: %w", err)
 	}
@@ -164,6 +217,49 @@ func shouldBeFix(fpath string) bool {
 	return SmFixExtensions[ext]
 }
 
+// urlHost joins ip and port for a URL, IPv6 literals are bracketed and the
+// zone separator is escaped: "[fe80::1%25eth0]:8080".
+func urlHost(ip, port string) string {
+	return strings.Replace(net.JoinHostPort(ip, port), "%", "%25", 1)
+}
+
+// normalizeHost strips the brackets of an IPv6 literal, "[fe80::1%eth0]".
+func normalizeHost(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// udpAddrIP returns the address of a peer, with the zone if it is needed to
+// reach the address again (IPv6 link-local).
+func udpAddrIP(a *net.UDPAddr) string {
+	if a.Zone != "" && a.IP.IsLinkLocalUnicast() {
+		return a.IP.String() + "%" + a.Zone
+	}
+	return a.IP.String()
+}
+
+// withZone adds the zone of peer to ip if ip is a link-local IPv6 address
+// without one, a printer reports its address without knowing our interface.
+func withZone(ip, peer string) string {
+	if strings.Contains(ip, "%") {
+		return ip
+	}
+	_, zone, ok := strings.Cut(peer, "%")
+	if parsed := net.ParseIP(ip); ok && parsed != nil && parsed.To4() == nil && parsed.IsLinkLocalUnicast() {
+		return ip + "%" + zone
+	}
+	return ip
+}
+
+func envOr(key string, defaultValue string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return defaultValue
+}
+
 func parseIntEnv(key string, defaultValue int) int {
 	if value, ok := os.LookupEnv(key); ok {
 		if v, err := strconv.Atoi(value); err == nil {
@@ -190,3 +286,30 @@ func parseDurationEnv(key string, defaultValue time.Duration) time.Duration {
 	}
 	return defaultValue
 }
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it to path, readers see either the old or the new content.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// subfolders of a watched folder that receive the uploaded files
+const (
+	watchDone   = "done"
+	watchFailed = "failed"
+)
+
+// watchedFile is a file that is uploaded once it stops growing.
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	since   time.Time // last change
+}
+
+/*
+watcher uploads the files that appear in a hot folder. Files in the folder
+go to the default printer, files in a subfolder named after a known printer
+(ID, alias or IP in hosts.yaml) go to that printer:
+
+	exports/              -> -host
+	exports/J1V19/        -> J1V19
+	exports/done/         uploaded files
+	exports/J1V19/failed/ files that could not be uploaded
+*/
+type watcher struct {
+	dir     string
+	printer *Printer // default printer
+	ls      *LocalStorage
+	bridge  *bridge
+	folders map[string]*Printer // watched folders
+	unknown map[string]bool     // subfolders without printer, logged once
+	pending map[string]*watchedFile
+	events  *fsnotify.Watcher // nil when polling
+}
+
+func newWatcher(dir string, printer *Printer, ls *LocalStorage) *watcher {
+	return &watcher{
+		dir:     filepath.Clean(dir),
+		printer: printer,
+		ls:      ls,
+		bridge:  newBridge(printer, ls),
+		folders: map[string]*Printer{},
+		unknown: map[string]bool{},
+		pending: map[string]*watchedFile{},
+	}
+}
+
+// run watches the folders until the program stops. It polls if -watch-poll
+// is set or the folders can not be watched.
+func (w *watcher) run() error {
+	if !WatchPoll {
+		events, err := fsnotify.NewWatcher()
+		if err != nil {
+			logWatch.Warn("Can not watch, polling", "dir", w.dir, "err", err)
+		} else {
+			w.events = events
+			defer func() {
+				if w.events != nil {
+					w.events.Close()
+				}
+			}()
+		}
+	}
+	if err := w.scanFolders(); err != nil {
+		return err
+	}
+	w.scanFiles()
+
+	mode := "watching"
+	if w.events == nil {
+		mode = "polling"
+	}
+	logWatch.Info("Hot folder", "dir", w.dir, "mode", mode, "printer", w.printer.String())
+
+	ticker := time.NewTicker(WatchInterval)
+	defer ticker.Stop()
+	for {
+		var events <-chan fsnotify.Event
+		var errs <-chan error
+		if w.events != nil {
+			events, errs = w.events.Events, w.events.Errors
+		}
+		select {
+		case ev := <-events:
+			w.handle(ev)
+		case err := <-errs:
+			logWatch.Warn("Watch error", "err", err)
+		case <-ticker.C:
+			if w.events == nil {
+				if err := w.scanFolders(); err != nil {
+					logWatch.Warn("Watch error", "err", err)
+					continue
+				}
+				w.scanFiles()
+			}
+			w.check()
+		}
+	}
+}
+
+// handle tracks the files created or written in a watched folder, a new
+// subfolder may be routed to a printer.
+func (w *watcher) handle(ev fsnotify.Event) {
+	if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+		return
+	}
+	logWatch.Debug("Watch event", "event", ev.String())
+	if filepath.Dir(ev.Name) == w.dir && ev.Has(fsnotify.Create) {
+		if st, err := os.Stat(ev.Name); err == nil && st.IsDir() {
+			if err := w.scanFolders(); err != nil {
+				logWatch.Warn("Watch error", "err", err)
+			}
+			w.scanFiles()
+			return
+		}
+	}
+	if _, ok := w.folders[filepath.Dir(ev.Name)]; ok && watchable(filepath.Base(ev.Name)) {
+		w.track(ev.Name)
+	}
+}
+
+// scanFolders finds the subfolders named after a printer.
+func (w *watcher) scanFolders() error {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+	folders := map[string]*Printer{w.dir: w.printer}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() || name == watchDone || name == watchFailed || strings.HasPrefix(name, ".") {
+			continue
+		}
+		p := w.ls.Find(name)
+		if p == nil {
+			if !w.unknown[name] {
+				logWatch.Warn("No printer named like the folder, ignored", "dir", filepath.Join(w.dir, name), "hosts", KnownHosts)
+				w.unknown[name] = true
+			}
+			continue
+		}
+		folders[filepath.Join(w.dir, name)] = p
+	}
+
+	for folder, p := range folders {
+		if _, ok := w.folders[folder]; ok {
+			continue
+		}
+		if w.events != nil {
+			if err := w.events.Add(folder); err != nil {
+				logWatch.Warn("Can not watch, polling", "dir", folder, "err", err)
+				w.events.Close()
+				w.events = nil
+			}
+		}
+		if folder != w.dir {
+			logWatch.Info("Hot folder", "dir", folder, "printer", p.String())
+		}
+	}
+	w.folders = folders
+	return nil
+}
+
+// scanFiles tracks the files in the watched folders.
+func (w *watcher) scanFiles() {
+	for folder := range w.folders {
+		entries, err := os.ReadDir(folder)
+		if err != nil {
+			logWatch.Warn("Watch error", "err", err)
+			continue
+		}
+		for _, e := range entries {
+			if e.Type().IsRegular() && watchable(e.Name()) {
+				w.track(filepath.Join(folder, e.Name()))
+			}
+		}
+	}
+}
+
+// watchable tells if a file is uploaded, hidden files are skipped.
+func watchable(name string) bool {
+	_, ok := SmFixExtensions[strings.ToLower(filepath.Ext(name))]
+	return ok && !strings.HasPrefix(name, ".")
+}
+
+func (w *watcher) track(path string) {
+	if _, ok := w.pending[path]; !ok {
+		w.pending[path] = &watchedFile{size: -1}
+	}
+}
+
+// check uploads the files that did not change for -watch-settle.
+func (w *watcher) check() {
+	now := time.Now()
+	for path, f := range w.pending {
+		st, err := os.Stat(path)
+		if err != nil {
+			delete(w.pending, path)
+			continue
+		}
+		if st.Size() != f.size || !st.ModTime().Equal(f.modTime) {
+			f.size, f.modTime, f.since = st.Size(), st.ModTime(), now
+			continue
+		}
+		if now.Sub(f.since) < WatchSettle {
+			continue
+		}
+		delete(w.pending, path)
+		w.upload(path)
+	}
+}
+
+// upload sends the file at path to the printer of its folder and moves it
+// to done or failed.
+func (w *watcher) upload(path string) {
+	printer, ok := w.folders[filepath.Dir(path)]
+	if !ok {
+		return
+	}
+	err := w.send(printer, path)
+	dest := watchDone
+	if err != nil {
+		logWatch.Error("Upload failed", "file", path, "printer", printerKey(printer), "err", err)
+		dest = watchFailed
+	}
+	if moved, err := moveInto(path, filepath.Join(filepath.Dir(path), dest)); err != nil {
+		logWatch.Error("Can not move", "file", path, "err", err)
+	} else {
+		logWatch.Debug("Moved", "file", path, "to", moved)
+	}
+	if err := w.ls.Save(); err != nil {
+		logWatch.Error("Error saving known hosts", "err", err)
+	}
+}
+
+func (w *watcher) send(printer *Printer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	payload := NewPayload(f, st.Name(), st.Size())
+	logWatch.Info("Uploading file", "file", payload.Name, "size", payload.ReadableSize(), "printer", printerKey(printer))
+	return w.bridge.upload(context.Background(), printer, payload, "")
+}
+
+// moveInto moves the file at path into dir, an existing file of the same
+// name is kept and a timestamp is added to the name.
+func moveInto(path, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := filepath.Base(path)
+	dst := filepath.Join(dir, name)
+	if _, err := os.Stat(dst); err == nil {
+		ext := filepath.Ext(name)
+		dst = filepath.Join(dir, fmt.Sprintf("%s_%s%s", strings.TrimSuffix(name, ext), time.Now().Format("20060102-150405"), ext))
+	}
+	return dst, os.Rename(path, dst)
+}
+
+// runWatchDir implements "sm2uploader watch-dir <dir> [options]".
+func runWatchDir(args []string) int {
+	// the directory may come before the options
+	var dir string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		dir, args = args[0], args[1:]
+	}
+	if err := parseOptions(args); err != nil {
+		return fail(err)
+	}
+	if dir == "" && flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+	if dir == "" {
+		return fail(invalidInput("no directory, use watch-dir <dir> [options]"))
+	}
+	if st, err := os.Stat(dir); err != nil {
+		return fail(invalidInput("%s", err))
+	} else if !st.IsDir() {
+		return fail(invalidInput("%s is not a directory", dir))
+	}
+	if WatchInterval <= 0 {
+		return fail(invalidInput("-watch-interval must be positive"))
+	}
+
+	s, err := openSession()
+	if err != nil {
+		return fail(err)
+	}
+	defer s.close()
+
+	// use the known hosts entry, so a new token is saved
+	s.ls.Add(s.printer)
+	if p := s.ls.Get(s.printer.ID); s.printer.ID != "" && p != nil {
+		s.printer = p
+	}
+
+	if err := newWatcher(dir, s.printer, s.ls).run(); err != nil {
+		return fail(fmt.Errorf("%w: %w", errInvalidInput, err))
+	}
+	return exitOK
+}